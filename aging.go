@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// agingBuckets are the ranges of days since the last movement; the last one is open-ended
+var agingBuckets = []struct {
+	Label   string
+	MaxDays int
+}{
+	{"0-90", 90},
+	{"91-180", 180},
+	{"181-365", 365},
+	{">365", -1},
+}
+
+// agingBucket returns the index of the bucket for an age in days
+func agingBucket(days int) int {
+	for i, bucket := range agingBuckets {
+		if days <= bucket.MaxDays {
+			return i
+		}
+	}
+	return len(agingBuckets) - 1
+}
+
+// FindAgedStock returns the groups with a positive balance whose last movement (MAX(journalDate))
+// is at least minDays before now, oldest first
+func (cs *CleanupService) FindAgedStock(now time.Time, minDays int, filter BalanceFilter) ([]AgedStock, error) {
+	filter.NegativeOnly = false
+	balances, err := cs.FindBalances(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var stock []AgedStock
+	for _, balance := range balances {
+		if balance.NetBalance <= 0 {
+			continue
+		}
+
+		lastTxn, err := time.Parse("2006-01-02", dateOnly(balance.LastTxnDate))
+		if err != nil {
+			return nil, fmt.Errorf("group %d/%d/%d/%d: invalid last transaction date %q",
+				balance.ReferenceFk, balance.ItemFk, balance.LocationFk, balance.ShopFk, balance.LastTxnDate)
+		}
+
+		age := int(today.Sub(lastTxn).Hours() / 24)
+		if age < minDays {
+			continue
+		}
+		stock = append(stock, AgedStock{ItemBalance: balance, AgeDays: age, Bucket: agingBuckets[agingBucket(age)].Label})
+	}
+
+	sort.SliceStable(stock, func(a, b int) bool {
+		return stock[a].AgeDays > stock[b].AgeDays
+	})
+	return stock, nil
+}
+
+// AgingTotals sums the aged stock per age bucket, per shop or per shop and location with byLocation set
+func AgingTotals(stock []AgedStock, byLocation bool) []AgingTotal {
+	type totalKey struct{ shop, location int }
+	totals := make(map[totalKey]*AgingTotal)
+	var keys []totalKey
+
+	for _, s := range stock {
+		key := totalKey{shop: s.ShopFk}
+		if byLocation {
+			key.location = s.LocationFk
+		}
+		total, ok := totals[key]
+		if !ok {
+			total = &AgingTotal{
+				ShopFk:     key.shop,
+				LocationFk: key.location,
+				Groups:     make([]int, len(agingBuckets)),
+				Quantity:   make([]float64, len(agingBuckets)),
+			}
+			totals[key] = total
+			keys = append(keys, key)
+		}
+
+		bucket := agingBucket(s.AgeDays)
+		total.Groups[bucket]++
+		total.Quantity[bucket] += s.NetBalance
+	}
+
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].shop != keys[b].shop {
+			return keys[a].shop < keys[b].shop
+		}
+		return keys[a].location < keys[b].location
+	})
+
+	result := make([]AgingTotal, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *totals[key])
+	}
+	return result
+}
+
+// printAgingTotals lists groups and quantity per age bucket, per shop or per shop and location
+func printAgingTotals(totals []AgingTotal, byLocation bool, names *NameLookups) {
+	shopWidth := names.Width("shop", 8)
+	locationWidth := 0
+	if byLocation {
+		locationWidth = names.Width("location", 10)
+		fmt.Printf("%-*s %-*s ", shopWidth, "Shop", locationWidth, "Location")
+	} else {
+		fmt.Printf("%-*s ", shopWidth, "Shop")
+	}
+	for _, bucket := range agingBuckets {
+		fmt.Printf("%-20s ", bucket.Label+" (groups/qty)")
+	}
+	fmt.Println()
+	fmt.Println(strings.Repeat("-", 1+shopWidth+locationWidth+21*len(agingBuckets)))
+
+	for _, total := range totals {
+		if byLocation {
+			fmt.Printf("%-*s %-*s ", shopWidth, names.Label("shop", total.ShopFk),
+				locationWidth, names.Label("location", total.LocationFk))
+		} else {
+			fmt.Printf("%-*s ", shopWidth, names.Label("shop", total.ShopFk))
+		}
+		for i := range agingBuckets {
+			fmt.Printf("%-20s ", fmt.Sprintf("%d / %.3f", total.Groups[i], total.Quantity[i]))
+		}
+		fmt.Println()
+	}
+}
+
+// ShowAgedStock displays one page of aged stock (pageSize 0 shows all), oldest first,
+// followed by the totals per age bucket for each shop and location over all groups
+func ShowAgedStock(stock []AgedStock, names *NameLookups, page, pageSize int) {
+	if len(stock) == 0 {
+		fmt.Println("No groups with positive balance found without recent movement.")
+		return
+	}
+
+	start, end, page, pages := pageBounds(len(stock), page, pageSize)
+	itemWidth := names.Width("item", 8)
+	locationWidth := names.Width("location", 10)
+	shopWidth := names.Width("shop", 8)
+
+	fmt.Printf("\nAged stock %d-%d of %d (page %d of %d):\n", start+1, end, len(stock), page, pages)
+	fmt.Printf("%-10s %-*s %-*s %-*s %-12s %-12s %-8s %s\n",
+		"RefFk", itemWidth, "Item", locationWidth, "Location", shopWidth, "Shop",
+		"Balance", "LastTxn", "AgeDays", "Bucket")
+	fmt.Println(strings.Repeat("-", 62+itemWidth+locationWidth+shopWidth))
+	for _, s := range stock[start:end] {
+		fmt.Printf("%-10d %-*s %-*s %-*s %-12.3f %-12s %-8d %s\n",
+			s.ReferenceFk, itemWidth, names.Label("item", s.ItemFk),
+			locationWidth, names.Label("location", s.LocationFk), shopWidth, names.Label("shop", s.ShopFk),
+			s.NetBalance, dateOnly(s.LastTxnDate), s.AgeDays, s.Bucket)
+	}
+	if page < pages {
+		fmt.Printf("... use --page %d for more, --page-size 0 for all\n", page+1)
+	}
+
+	fmt.Println("\nAge buckets per shop:")
+	printAgingTotals(AgingTotals(stock, false), false, names)
+	fmt.Println("\nAge buckets per shop and location:")
+	printAgingTotals(AgingTotals(stock, true), true, names)
+}
+
+func (r *AgingReport) info() reportInfo {
+	return reportInfo{
+		Title: "Stock aging report",
+		Fields: []reportField{
+			{"run_id", "Run", r.RunID},
+			{"min_days", "No movement for at least (days)", r.MinDays},
+			{"filter", "Filter", r.Filter.String()},
+			{"generated_at", "Generated", r.GeneratedAt},
+		},
+	}
+}
+
+// tables converts the aged stock into the groups table and the bucket totals per location.
+// The per-shop totals of both come with the report formats.
+func (r *AgingReport) tables(names *NameLookups) []reportTable {
+	groups := reportTable{
+		Name:  "aged_stock",
+		Title: "Aged stock",
+		Sheet: "Aged stock",
+		Columns: []string{"ReferenceFk", "ItemFk", "LocationFk", "ShopFk", "NetBalance",
+			"LastTxnDate", "AgeDays", "AgeBucket"},
+		ShopColumn: 3,
+		SumColumns: []int{4},
+	}
+	for _, s := range r.Stock {
+		groups.Rows = append(groups.Rows, []any{s.ReferenceFk, s.ItemFk, s.LocationFk, s.ShopFk, s.NetBalance,
+			dateOnly(s.LastTxnDate), s.AgeDays, s.Bucket})
+	}
+
+	totals := reportTable{
+		Name:       "aging_totals",
+		Title:      "Age buckets per location",
+		Sheet:      "Age buckets",
+		Columns:    []string{"ShopFk", "LocationFk"},
+		ShopColumn: 0,
+	}
+	for _, bucket := range agingBuckets {
+		totals.SumColumns = append(totals.SumColumns, len(totals.Columns), len(totals.Columns)+1)
+		totals.Columns = append(totals.Columns, "Groups "+bucket.Label, "Quantity "+bucket.Label)
+	}
+	for _, t := range AgingTotals(r.Stock, true) {
+		row := []any{t.ShopFk, t.LocationFk}
+		for i := range agingBuckets {
+			row = append(row, t.Groups[i], t.Quantity[i])
+		}
+		totals.Rows = append(totals.Rows, row)
+	}
+
+	return []reportTable{groups.withNames(names), totals.withNames(names)}
+}
+
+// WriteAgingReport writes the aging report in each format to dir and returns the written files
+func WriteAgingReport(report *AgingReport, names *NameLookups, dir string, formats []string) ([]string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	names.loadBalances(agedBalances(report.Stock))
+	return writeReportFiles(filepath.Join(dir, "aging_"+report.RunID), report.info(), report.tables(names), formats)
+}
+
+// agedBalances returns the balance groups of aged stock
+func agedBalances(stock []AgedStock) []ItemBalance {
+	balances := make([]ItemBalance, len(stock))
+	for i, s := range stock {
+		balances[i] = s.ItemBalance
+	}
+	return balances
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAgingBucket(t *testing.T) {
+	for _, tt := range []struct {
+		days int
+		want string
+	}{
+		{0, "0-90"},
+		{90, "0-90"},
+		{91, "91-180"},
+		{180, "91-180"},
+		{181, "181-365"},
+		{365, "181-365"},
+		{366, ">365"},
+		{5000, ">365"},
+	} {
+		if got := agingBuckets[agingBucket(tt.days)].Label; got != tt.want {
+			t.Errorf("agingBucket(%d) = %s, want %s", tt.days, got, tt.want)
+		}
+	}
+}
+
+func TestAgingTotals(t *testing.T) {
+	stock := []AgedStock{
+		{ItemBalance: ItemBalance{ShopFk: 2, LocationFk: 4, NetBalance: 3}, AgeDays: 400},
+		{ItemBalance: ItemBalance{ShopFk: 1, LocationFk: 9, NetBalance: 5}, AgeDays: 100},
+		{ItemBalance: ItemBalance{ShopFk: 1, LocationFk: 8, NetBalance: 2.5}, AgeDays: 150},
+		{ItemBalance: ItemBalance{ShopFk: 1, LocationFk: 8, NetBalance: 1}, AgeDays: 30},
+	}
+
+	got := AgingTotals(stock, false)
+	want := []AgingTotal{
+		{ShopFk: 1, Groups: []int{1, 2, 0, 0}, Quantity: []float64{1, 7.5, 0, 0}},
+		{ShopFk: 2, Groups: []int{0, 0, 0, 1}, Quantity: []float64{0, 0, 0, 3}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AgingTotals = %+v, want %+v", got, want)
+	}
+
+	byLocation := AgingTotals(stock, true)
+	var locations []int
+	for _, total := range byLocation {
+		locations = append(locations, total.LocationFk)
+	}
+	if !reflect.DeepEqual(locations, []int{8, 9, 4}) {
+		t.Errorf("locations of the totals = %v, want [8 9 4] ordered by shop and location", locations)
+	}
+}
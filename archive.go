@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Archiver copies rows about to be hard-deleted or updated to a place outside the production tables.
+// Archive is called inside the production transaction before the DELETE or UPDATE and Flush right
+// before that transaction commits; both must fail when the copy cannot be verified,
+// so the deletion is rolled back.
+type Archiver interface {
+	Archive(tx dbExecutor, tableName string, ids []int) error
+	Flush() error
+	Close() error
+}
+
+// NewArchiver creates the archiver selected by ARCHIVE_TARGET
+func NewArchiver(db *sql.DB, logger *log.Logger, config *Config) (Archiver, error) {
+	switch config.ArchiveTarget {
+	case "none":
+		return noArchiver{}, nil
+	case "schema":
+		return &schemaArchiver{db: db, runID: config.RunID, created: make(map[string]bool)}, nil
+	case "database":
+		db, err := ConnectArchiveDatabase(config)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to archive database: %v", err)
+		}
+		return &databaseArchiver{db: db, logger: logger, created: make(map[string]bool)}, nil
+	case "file":
+		return newFileArchiver(config, logger)
+	case "s3":
+		return newS3Archiver(config, logger)
+	}
+	return nil, fmt.Errorf("unknown ARCHIVE_TARGET %q", config.ArchiveTarget)
+}
+
+// noArchiver deletes without keeping a copy
+type noArchiver struct{}
+
+func (noArchiver) Archive(tx dbExecutor, tableName string, ids []int) error { return nil }
+func (noArchiver) Flush() error                                             { return nil }
+func (noArchiver) Close() error                                             { return nil }
+
+// schemaArchiver copies rows into <table>_archive tables in the production schema.
+// The archive tables are created on the plain connection pool, since the DDL would
+// implicitly commit the production transaction.
+type schemaArchiver struct {
+	db      *sql.DB
+	runID   string
+	created map[string]bool
+}
+
+func (a *schemaArchiver) Archive(tx dbExecutor, tableName string, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if !a.created[tableName] {
+		err := createArchiveTable(a.db, tableName)
+		if err != nil {
+			return fmt.Errorf("creating %s_archive: %v", tableName, err)
+		}
+		a.created[tableName] = true
+	}
+	return archiveByIDs(tx, tableName, ids, a.runID)
+}
+
+func (a *schemaArchiver) Flush() error { return nil }
+func (a *schemaArchiver) Close() error { return nil }
+
+// databaseArchiver copies rows into tables of the same name in a separate archive database.
+// Each batch is committed in the archive and read back to compare row count and checksum
+// before the production DELETE runs.
+type databaseArchiver struct {
+	db      *sql.DB
+	logger  *log.Logger
+	created map[string]bool
+}
+
+var foreignKeyLine = regexp.MustCompile(`(?m)^\s*CONSTRAINT .* FOREIGN KEY .*$\n?`)
+var autoIncrementOption = regexp.MustCompile(`\s*AUTO_INCREMENT=\d+`)
+
+func (a *databaseArchiver) Archive(tx dbExecutor, tableName string, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err := a.ensureTable(tx, tableName)
+	if err != nil {
+		return err
+	}
+
+	inClause := joinIDs(ids)
+	columns, rows, err := selectRowsByIDs(tx, tableName, inClause)
+	if err != nil {
+		return fmt.Errorf("reading %s rows to archive: %v", tableName, err)
+	}
+	checksum := rowsChecksum(rows)
+
+	atx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer atx.Rollback()
+
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	values := make([]string, len(rows))
+	var args []any
+	for i, row := range rows {
+		values[i] = placeholders
+		args = append(args, row...)
+	}
+
+	// REPLACE keeps a re-run idempotent when an earlier production delete was rolled back
+	_, err = atx.Exec(fmt.Sprintf("REPLACE INTO %s (`%s`) VALUES %s",
+		tableName, strings.Join(columns, "`,`"), strings.Join(values, ",")), args...)
+	if err != nil {
+		return fmt.Errorf("copying %s rows to archive: %v", tableName, err)
+	}
+
+	err = atx.Commit()
+	if err != nil {
+		return err
+	}
+
+	_, archived, err := selectRowsByIDs(a.db, tableName, inClause)
+	if err != nil {
+		return fmt.Errorf("verifying archived %s rows: %v", tableName, err)
+	}
+	if len(archived) != len(rows) {
+		return fmt.Errorf("archive verification failed for %s: %d rows copied, %d found", tableName, len(rows), len(archived))
+	}
+	if rowsChecksum(archived) != checksum {
+		return fmt.Errorf("archive verification failed for %s: checksum mismatch", tableName)
+	}
+
+	a.logger.Printf("Archived %d %s rows to archive database (sha256 %s)", len(rows), tableName, checksum)
+	return nil
+}
+
+// ensureTable creates the archive table from the production definition, without foreign keys
+func (a *databaseArchiver) ensureTable(tx dbExecutor, tableName string) error {
+	if a.created[tableName] {
+		return nil
+	}
+
+	var name, ddl string
+	err := tx.QueryRow("SHOW CREATE TABLE "+tableName).Scan(&name, &ddl)
+	if err != nil {
+		return fmt.Errorf("reading definition of %s: %v", tableName, err)
+	}
+
+	ddl = strings.Replace(ddl, "CREATE TABLE", "CREATE TABLE IF NOT EXISTS", 1)
+	ddl = foreignKeyLine.ReplaceAllString(ddl, "")
+	ddl = strings.Replace(ddl, ",\n)", "\n)", 1)
+	ddl = autoIncrementOption.ReplaceAllString(ddl, "")
+
+	_, err = a.db.Exec(ddl)
+	if err != nil {
+		return fmt.Errorf("creating archive table %s: %v", tableName, err)
+	}
+
+	a.created[tableName] = true
+	return nil
+}
+
+func (a *databaseArchiver) Flush() error { return nil }
+
+func (a *databaseArchiver) Close() error {
+	return a.db.Close()
+}
+
+// selectRowsByIDs reads full rows ordered by id, returning the column names and values
+func selectRowsByIDs(q dbExecutor, tableName, inClause string) ([]string, [][]any, error) {
+	rows, err := q.Query(fmt.Sprintf("SELECT * FROM %s WHERE id IN (%s) ORDER BY id", tableName, inClause))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result [][]any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, nil, err
+		}
+		result = append(result, values)
+	}
+
+	return columns, result, rows.Err()
+}
+
+// rowsChecksum returns the SHA-256 of the rows with every value in a canonical text form
+func rowsChecksum(rows [][]any) string {
+	hash := sha256.New()
+	for _, row := range rows {
+		for _, value := range row {
+			text := formatValue(value)
+			fmt.Fprintf(hash, "%d:%s|", len(text), text)
+		}
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// formatValue renders a scanned column value as text, NULL as \N
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return `\N`
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// joinIDs formats ids as a comma-separated IN list
+func joinIDs(ids []int) string {
+	var sb strings.Builder
+	for i, id := range ids {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(fmt.Sprintf("%d", id))
+	}
+	return sb.String()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// archiveEncryption is the algorithm recorded in the manifest of encrypted archives
+const archiveEncryption = "aes-256-gcm"
+
+// archiveKey encrypts archive files as a sequence of frames, one per gzip member:
+// 4-byte big-endian length, 12-byte random nonce, ciphertext with GCM tag.
+// The file name and frame index are authenticated, so frames cannot be moved or reordered.
+type archiveKey struct {
+	aead        cipher.AEAD
+	fingerprint string
+}
+
+// loadArchiveKey reads the 32-byte key (hex or base64) from ARCHIVE_KEY_FILE or ARCHIVE_KEY.
+// It returns nil when no key is configured.
+func loadArchiveKey(config *Config) (*archiveKey, error) {
+	encoded := config.ArchiveKey
+	if config.ArchiveKeyFile != "" {
+		data, err := os.ReadFile(config.ArchiveKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading archive key: %v", err)
+		}
+		encoded = string(data)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("archive key must be 32 bytes, hex or base64 encoded")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(key)
+	return &archiveKey{aead: aead, fingerprint: "sha256:" + hex.EncodeToString(sum[:8])}, nil
+}
+
+// seal encrypts one frame of the named file
+func (k *archiveKey) seal(plain []byte, name string, index int) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := k.aead.Seal(nonce, nonce, plain, frameAAD(name, index))
+	frame := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	return append(frame, sealed...), nil
+}
+
+// open decrypts all frames of the named file and returns the concatenated plaintext
+func (k *archiveKey) open(r io.Reader, name string) ([]byte, error) {
+	var plain []byte
+	header := make([]byte, 4)
+	for index := 0; ; index++ {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return plain, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s frame %d: %v", name, index, err)
+		}
+
+		sealed := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(r, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("%s frame %d: %v", name, index, err)
+		}
+		if len(sealed) < k.aead.NonceSize() {
+			return nil, fmt.Errorf("%s frame %d: too short", name, index)
+		}
+
+		nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+		data, err := k.aead.Open(nil, nonce, ciphertext, frameAAD(name, index))
+		if err != nil {
+			return nil, fmt.Errorf("%s frame %d: decryption failed (wrong key or corrupted file)", name, index)
+		}
+		plain = append(plain, data...)
+	}
+}
+
+func frameAAD(name string, index int) []byte {
+	return []byte(fmt.Sprintf("%s#%d", name, index))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testArchiveKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func testKey(t *testing.T, encoded string) *archiveKey {
+	key, err := loadArchiveKey(&Config{ArchiveKey: encoded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestLoadArchiveKey(t *testing.T) {
+	hexKey := testKey(t, testArchiveKey)
+	if !strings.HasPrefix(hexKey.fingerprint, "sha256:") || len(hexKey.fingerprint) != len("sha256:")+16 {
+		t.Errorf("fingerprint %q, want sha256: and 8 hex bytes", hexKey.fingerprint)
+	}
+
+	raw := make([]byte, 32)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	if base64Key := testKey(t, base64.StdEncoding.EncodeToString(raw)); base64Key.fingerprint != hexKey.fingerprint {
+		t.Errorf("base64 key fingerprint %s differs from the same hex key %s", base64Key.fingerprint, hexKey.fingerprint)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "archive.key")
+	if err := os.WriteFile(keyFile, []byte(testArchiveKey+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fileKey, err := loadArchiveKey(&Config{ArchiveKey: "ignored", ArchiveKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileKey.fingerprint != hexKey.fingerprint {
+		t.Errorf("key file fingerprint %s, want %s", fileKey.fingerprint, hexKey.fingerprint)
+	}
+
+	if key, err := loadArchiveKey(&Config{}); key != nil || err != nil {
+		t.Errorf("no key configured: %v, %v, want nil, nil", key, err)
+	}
+	if _, err := loadArchiveKey(&Config{ArchiveKey: "abcd"}); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+func TestArchiveKeySealOpen(t *testing.T) {
+	key := testKey(t, testArchiveKey)
+	frames := [][]byte{[]byte("first gzip member"), []byte("second"), {}}
+
+	var file bytes.Buffer
+	for i, frame := range frames {
+		sealed, err := key.seal(frame, "journal.jsonl.gz.enc", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(sealed)
+	}
+	data := file.Bytes()
+
+	plain, err := key.open(bytes.NewReader(data), "journal.jsonl.gz.enc")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if string(plain) != "first gzip membersecond" {
+		t.Errorf("open = %q", plain)
+	}
+
+	// The file name is authenticated
+	if _, err := key.open(bytes.NewReader(data), "form_detail.jsonl.gz.enc"); err == nil || !strings.Contains(err.Error(), "frame 0") {
+		t.Errorf("open under another name: error = %v, want frame 0 failure", err)
+	}
+
+	// Swapping frames breaks the frame index
+	first := 4 + int(binary.BigEndian.Uint32(data))
+	second := 4 + int(binary.BigEndian.Uint32(data[first:]))
+	swapped := append(append(append([]byte(nil), data[first:first+second]...), data[:first]...), data[first+second:]...)
+	if _, err := key.open(bytes.NewReader(swapped), "journal.jsonl.gz.enc"); err == nil {
+		t.Error("open accepted reordered frames")
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[10] ^= 1
+	if _, err := key.open(bytes.NewReader(tampered), "journal.jsonl.gz.enc"); err == nil {
+		t.Error("open accepted a modified frame")
+	}
+
+	if _, err := key.open(bytes.NewReader(data[:len(data)-3]), "journal.jsonl.gz.enc"); err == nil {
+		t.Error("open accepted a truncated file")
+	}
+
+	other := testKey(t, strings.Repeat("ff", 32))
+	if _, err := other.open(bytes.NewReader(data), "journal.jsonl.gz.enc"); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("open with another key: error = %v, want wrong key", err)
+	}
+}
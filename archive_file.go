@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileArchiver writes deleted rows to per-run <table>.jsonl.gz or <table>.csv.gz files.
+// The run directory is only created when the first rows are archived.
+// Every batch is appended as a separate gzip member and the manifest with row counts and
+// SHA-256 checksums is rewritten before Archive returns, so it is on disk before the commit.
+// With a key, every member is encrypted as one frame and the files get an .enc suffix.
+type fileArchiver struct {
+	dir    string
+	format string
+	runID  string
+	key    *archiveKey
+	logger *log.Logger
+	files  map[string]*archiveOutput
+	order  []string
+}
+
+// archiveOutput is an open archive file with its running checksum
+type archiveOutput struct {
+	name    string
+	file    *os.File
+	hash    hash.Hash
+	rows    int
+	bytes   int64
+	frames  int
+	columns []string
+}
+
+func newFileArchiver(config *Config, logger *log.Logger) (*fileArchiver, error) {
+	key, err := loadArchiveKey(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileArchiver{
+		dir:    filepath.Join(config.ArchiveDir, config.RunID),
+		format: config.ArchiveFormat,
+		runID:  config.RunID,
+		key:    key,
+		logger: logger,
+		files:  make(map[string]*archiveOutput),
+	}, nil
+}
+
+func (a *fileArchiver) Archive(tx dbExecutor, tableName string, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	columns, rows, err := selectRowsByIDs(tx, tableName, joinIDs(ids))
+	if err != nil {
+		return fmt.Errorf("reading %s rows to archive: %v", tableName, err)
+	}
+
+	out, err := a.open(tableName, columns)
+	if err != nil {
+		return err
+	}
+
+	err = a.writeMember(out, columns, rows)
+	if err != nil {
+		return fmt.Errorf("writing %s archive: %v", tableName, err)
+	}
+
+	err = a.writeManifest()
+	if err != nil {
+		return fmt.Errorf("writing archive manifest: %v", err)
+	}
+
+	a.logger.Printf("Archived %d %s rows to %s", len(rows), tableName, filepath.Join(a.dir, out.name))
+	return nil
+}
+
+// open returns the archive file of a table, creating it on first use
+func (a *fileArchiver) open(tableName string, columns []string) (*archiveOutput, error) {
+	if out, ok := a.files[tableName]; ok {
+		return out, nil
+	}
+
+	err := os.MkdirAll(a.dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("creating archive directory: %v", err)
+	}
+
+	name := fmt.Sprintf("%s.%s.gz", tableName, a.format)
+	if a.key != nil {
+		name += ".enc"
+	}
+	file, err := os.OpenFile(filepath.Join(a.dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("creating archive file: %v", err)
+	}
+
+	out := &archiveOutput{name: name, file: file, hash: sha256.New(), columns: columns}
+	a.files[tableName] = out
+	a.order = append(a.order, tableName)
+	return out, nil
+}
+
+// writeMember appends the rows as one gzip member, encrypted when a key is set, and syncs the file
+func (a *fileArchiver) writeMember(out *archiveOutput, columns []string, rows [][]any) error {
+	var member bytes.Buffer
+	zw := gzip.NewWriter(&member)
+
+	var err error
+	if a.format == "csv" {
+		err = writeCSVRows(zw, columns, rows, out.rows == 0)
+	} else {
+		err = writeJSONRows(zw, columns, rows)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+
+	data := member.Bytes()
+	if a.key != nil {
+		data, err = a.key.seal(data, out.name, out.frames)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.MultiWriter(out.file, out.hash).Write(data)
+	if err != nil {
+		return err
+	}
+	err = out.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	out.rows += len(rows)
+	out.bytes += int64(len(data))
+	out.frames++
+	return nil
+}
+
+// writeManifest replaces manifest.json with the current counts and checksums
+func (a *fileArchiver) writeManifest() error {
+	manifest := a.manifest()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(a.dir, "manifest.json")
+	err = os.WriteFile(path+".tmp", data, 0o640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (a *fileArchiver) manifest() ArchiveManifest {
+	manifest := ArchiveManifest{
+		RunID:     a.runID,
+		Format:    a.format,
+		UpdatedAt: time.Now().Format("2006-01-02 15:04:05"),
+		Files:     []ArchiveFile{},
+	}
+	if a.key != nil {
+		manifest.Encryption = archiveEncryption
+		manifest.KeyFingerprint = a.key.fingerprint
+	}
+	for _, table := range a.order {
+		out := a.files[table]
+		manifest.Files = append(manifest.Files, ArchiveFile{
+			Table:   table,
+			File:    out.name,
+			Columns: out.columns,
+			Rows:    out.rows,
+			Bytes:   out.bytes,
+			SHA256:  hex.EncodeToString(out.hash.Sum(nil)),
+		})
+	}
+	return manifest
+}
+
+// Flush has nothing to do, the files and manifest are synced by Archive
+func (a *fileArchiver) Flush() error { return nil }
+
+func (a *fileArchiver) Close() error {
+	var firstErr error
+	for _, table := range a.order {
+		if err := a.files[table].file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// writeJSONRows writes one JSON object per row, keyed by column name
+func writeJSONRows(w io.Writer, columns []string, rows [][]any) error {
+	encoder := json.NewEncoder(w)
+	for _, row := range rows {
+		record := make(map[string]any, len(columns))
+		for i, column := range columns {
+			record[column] = jsonValue(row[i])
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCSVRows writes the rows as CSV, with the column names first when header is set
+func writeCSVRows(w io.Writer, columns []string, rows [][]any, header bool) error {
+	writer := csv.NewWriter(w)
+	if header {
+		if err := writer.Write(columns); err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = formatValue(value)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// jsonValue converts a scanned column value for JSON output
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return formatValue(v)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// s3Archiver stages archive files like the file archiver and uploads them, with the
+// manifest, to S3_BUCKET/S3_PREFIX/<run id>/ before each production commit.
+// Each flush uploads only the bytes appended since the previous one, as a separate object
+// <file>.<part number>; they always end on a gzip member, so the parts concatenate to the file.
+// The S3 manifest lists the parts of every file with their checksums.
+type s3Archiver struct {
+	*fileArchiver
+	client   *s3Client
+	prefix   string
+	partSize int64
+	parts    map[string][]ArchivePart
+	uploaded map[string]int64
+}
+
+func newS3Archiver(config *Config, logger *log.Logger) (*s3Archiver, error) {
+	files, err := newFileArchiver(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Archiver{
+		fileArchiver: files,
+		client:       client,
+		prefix:       path.Join(config.S3Prefix, config.RunID),
+		partSize:     int64(config.S3PartSizeMB) * 1024 * 1024,
+		parts:        make(map[string][]ArchivePart),
+		uploaded:     make(map[string]int64),
+	}, nil
+}
+
+// Flush uploads what was appended to the archive files since the last flush and then the manifest
+func (a *s3Archiver) Flush() error {
+	manifest := a.manifest()
+	changed := false
+	for i, file := range manifest.Files {
+		offset := a.uploaded[file.File]
+		if file.Bytes > offset {
+			part, err := a.uploadPart(file.File, offset, file.Bytes-offset)
+			if err != nil {
+				return err
+			}
+			a.parts[file.File] = append(a.parts[file.File], part)
+			a.uploaded[file.File] = file.Bytes
+			a.logger.Printf("Uploaded %s (%d bytes, sha256 %s) to s3://%s/%s",
+				part.File, part.Bytes, part.SHA256, a.client.bucket, path.Join(a.prefix, part.File))
+			changed = true
+		}
+		manifest.Files[i].Parts = a.parts[file.File]
+	}
+
+	if !changed {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = a.client.PutObject(path.Join(a.prefix, "manifest.json"), data)
+	if err != nil {
+		return fmt.Errorf("uploading manifest: %v", err)
+	}
+	return nil
+}
+
+// uploadPart uploads size bytes of a staged archive file from offset as the file's next part
+func (a *s3Archiver) uploadPart(name string, offset, size int64) (ArchivePart, error) {
+	file, err := os.Open(filepath.Join(a.dir, name))
+	if err != nil {
+		return ArchivePart{}, err
+	}
+	defer file.Close()
+
+	part := ArchivePart{File: fmt.Sprintf("%s.%05d", name, len(a.parts[name])+1), Bytes: size}
+	key := path.Join(a.prefix, part.File)
+	section := io.NewSectionReader(file, offset, size)
+	if size <= a.partSize {
+		data, err := io.ReadAll(section)
+		if err != nil {
+			return ArchivePart{}, err
+		}
+		err = a.client.PutObject(key, data)
+		if err != nil {
+			return ArchivePart{}, fmt.Errorf("uploading %s: %v", key, err)
+		}
+		part.SHA256 = sha256Hex(data)
+		return part, nil
+	}
+
+	part.SHA256, err = a.client.UploadMultipart(key, section, a.partSize)
+	if err != nil {
+		return ArchivePart{}, err
+	}
+	return part, nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-process S3 server implementing the path-style requests of s3Client:
+// PutObject, GetObject and the multipart upload calls. failPart makes that part number fail
+// and corruptPuts stores objects with their last byte flipped, returning the matching ETag.
+type fakeS3 struct {
+	mu          sync.Mutex
+	bucket      string
+	objects     map[string][]byte
+	uploads     map[string]map[int][]byte
+	aborted     []string
+	puts        []string
+	gets        int
+	failPart    int
+	corruptPuts bool
+	nextID      int
+}
+
+// fakeETag is the ETag S3 returns for a PUT or part: the hex MD5 of the body
+func fakeETag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("x-amz-content-sha256") != sha256Hex(body) {
+		http.Error(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>", http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+			return
+		}
+	}
+	if f.corruptPuts && r.Method == http.MethodPut && len(body) > 0 {
+		body = append([]byte(nil), body...)
+		body[len(body)-1] ^= 0xff
+	}
+
+	prefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPut && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+			return
+		}
+		if number == f.failPart {
+			http.Error(w, "<Error><Code>InternalError</Code></Error>", http.StatusInternalServerError)
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodPost && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+			return
+		}
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, "<Error><Code>MalformedXML</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok || part.PartNumber != i+1 || part.ETag != fakeETag(data) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			object = append(object, data...)
+		}
+		f.objects[key] = object
+		f.puts = append(f.puts, key)
+		delete(f.uploads, uploadID)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		f.aborted = append(f.aborted, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.puts = append(f.puts, key)
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodGet:
+		f.gets++
+		object, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(object)
+
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+func testS3Config(t *testing.T, endpoint string) *Config {
+	return &Config{
+		RunID:         "20250101_120000",
+		ArchiveDir:    t.TempDir(),
+		ArchiveFormat: "jsonl",
+		S3Endpoint:    endpoint,
+		S3Region:      "us-east-1",
+		S3Bucket:      "archive",
+		S3Prefix:      "cleanup",
+		S3AccessKey:   "test-key",
+		S3SecretKey:   "test-secret",
+		S3PartSizeMB:  5,
+	}
+}
+
+func testBytes(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestS3ClientMultipartUpload(t *testing.T) {
+	fake, server := newFakeS3(t, "archive")
+	client, err := newS3Client(testS3Config(t, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		size     int
+		partSize int64
+	}{
+		{"several parts", 25, 10},
+		{"exact multiple", 20, 10},
+		{"single part", 7, 10},
+		{"empty file", 0, 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testBytes(tt.size)
+			key := "run/" + strings.ReplaceAll(tt.name, " ", "_")
+
+			sum, err := client.UploadMultipart(key, bytes.NewReader(data), tt.partSize)
+			if err != nil {
+				t.Fatalf("UploadMultipart: %v", err)
+			}
+			if !bytes.Equal(fake.objects[key], data) {
+				t.Errorf("object has %d bytes, want the %d bytes of the file", len(fake.objects[key]), len(data))
+			}
+			if sum != sha256Hex(data) {
+				t.Errorf("UploadMultipart checksum = %s, want %s", sum, sha256Hex(data))
+			}
+		})
+	}
+
+	if len(fake.uploads) != 0 || len(fake.aborted) != 0 {
+		t.Errorf("%d uploads left open and %d aborted, want none", len(fake.uploads), len(fake.aborted))
+	}
+	if fake.gets != 0 {
+		t.Errorf("uploads downloaded %d objects to verify them", fake.gets)
+	}
+}
+
+func TestS3ClientRejectsCorruptedUpload(t *testing.T) {
+	fake, server := newFakeS3(t, "archive")
+	fake.corruptPuts = true
+	client, err := newS3Client(testS3Config(t, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.PutObject("run/manifest.json", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "does not match the MD5") {
+		t.Errorf("PutObject error = %v, want an ETag mismatch", err)
+	}
+
+	data := testBytes(25)
+	_, err = client.UploadMultipart("run/journal.jsonl.gz", bytes.NewReader(data), 10)
+	if err == nil || !strings.Contains(err.Error(), "part 1") {
+		t.Errorf("UploadMultipart error = %v, want a part 1 ETag mismatch", err)
+	}
+	if len(fake.aborted) != 1 {
+		t.Errorf("aborted uploads = %v, want one", fake.aborted)
+	}
+}
+
+func TestS3ClientAbortsFailedUpload(t *testing.T) {
+	fake, server := newFakeS3(t, "archive")
+	fake.failPart = 2
+	client, err := newS3Client(testS3Config(t, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testBytes(25)
+	_, err = client.UploadMultipart("run/journal.jsonl.gz", bytes.NewReader(data), 10)
+	if err == nil || !strings.Contains(err.Error(), "part 2") {
+		t.Fatalf("UploadMultipart error = %v, want a part 2 failure", err)
+	}
+	if len(fake.aborted) != 1 || fake.aborted[0] != "run/journal.jsonl.gz" {
+		t.Errorf("aborted uploads = %v, want run/journal.jsonl.gz", fake.aborted)
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open after abort", len(fake.uploads))
+	}
+	if _, ok := fake.objects["run/journal.jsonl.gz"]; ok {
+		t.Error("object was created although the upload failed")
+	}
+}
+
+func TestS3ClientRejectsWrongBucket(t *testing.T) {
+	_, server := newFakeS3(t, "other")
+	client, err := newS3Client(testS3Config(t, server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.PutObject("run/manifest.json", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("PutObject error = %v, want 404", err)
+	}
+}
+
+func TestS3ArchiverFlushUploadsFilesAndManifest(t *testing.T) {
+	fake, server := newFakeS3(t, "archive")
+	config := testS3Config(t, server.URL)
+	archiver, err := newS3Archiver(config, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiver.partSize = 64
+
+	// Nothing archived yet: no upload and no directory
+	if err := archiver.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(fake.puts) != 0 {
+		t.Errorf("uploaded %v before anything was archived", fake.puts)
+	}
+	if _, err := os.Stat(archiver.dir); !os.IsNotExist(err) {
+		t.Errorf("archive directory exists before anything was archived")
+	}
+
+	columns := []string{"id", "quantity", "journalDate"}
+	archive := func(tables ...string) {
+		for _, table := range tables {
+			out, err := archiver.open(table, columns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rows [][]any
+			for i := 1; i <= 20; i++ {
+				rows = append(rows, []any{int64(out.rows + i), []byte(fmt.Sprintf("%d.000", i)), []byte("2024-01-31")})
+			}
+			if err := archiver.writeMember(out, columns, rows); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := archiver.writeManifest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive("journal", "form_detail")
+	if err := archiver.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// Unchanged files are not uploaded again
+	uploads := len(fake.puts)
+	if err := archiver.Flush(); err != nil {
+		t.Fatalf("second Flush: %v", err)
+	}
+	if len(fake.puts) != uploads {
+		t.Errorf("second Flush uploaded %v again", fake.puts[uploads:])
+	}
+
+	// Rows appended to journal go up as its second part, form_detail is left alone
+	archive("journal")
+	if err := archiver.Flush(); err != nil {
+		t.Fatalf("third Flush: %v", err)
+	}
+
+	manifestKey := "cleanup/20250101_120000/manifest.json"
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(fake.objects[manifestKey], &manifest); err != nil {
+		t.Fatalf("manifest %s: %v", manifestKey, err)
+	}
+	if manifest.RunID != config.RunID || len(manifest.Files) != 2 {
+		t.Fatalf("manifest run %q with %d files, want %q with 2", manifest.RunID, len(manifest.Files), config.RunID)
+	}
+	for _, file := range manifest.Files {
+		local, err := os.ReadFile(filepath.Join(archiver.dir, file.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var object []byte
+		for _, part := range file.Parts {
+			data := fake.objects["cleanup/20250101_120000/"+part.File]
+			if sha256Hex(data) != part.SHA256 || int64(len(data)) != part.Bytes {
+				t.Errorf("%s: uploaded %d bytes (sha256 %s), manifest says %d bytes (sha256 %s)",
+					part.File, len(data), sha256Hex(data), part.Bytes, part.SHA256)
+			}
+			object = append(object, data...)
+		}
+		if !bytes.Equal(object, local) || sha256Hex(object) != file.SHA256 {
+			t.Errorf("%s: the %d parts do not add up to the staged file", file.File, len(file.Parts))
+		}
+	}
+	if parts := len(manifest.Files[0].Parts); manifest.Files[0].Table != "journal" || parts != 2 || manifest.Files[0].Rows != 40 {
+		t.Errorf("journal has %d parts and %d rows, want 2 and 40", parts, manifest.Files[0].Rows)
+	}
+
+	uploaded := append([]string(nil), fake.puts...)
+	sort.Strings(uploaded)
+	want := []string{
+		"cleanup/20250101_120000/form_detail.jsonl.gz.00001",
+		"cleanup/20250101_120000/journal.jsonl.gz.00001",
+		"cleanup/20250101_120000/journal.jsonl.gz.00002",
+		"cleanup/20250101_120000/manifest.json",
+		"cleanup/20250101_120000/manifest.json",
+	}
+	if strings.Join(uploaded, ",") != strings.Join(want, ",") {
+		t.Errorf("uploaded %v, want %v", uploaded, want)
+	}
+	if fake.gets != 0 {
+		t.Errorf("Flush downloaded %d objects to verify them", fake.gets)
+	}
+
+	// The run reads back from S3 through the parts
+	cs := &CleanupService{config: config}
+	readFile, err := cs.archiveReader("s3://archive/cleanup/20250101_120000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readArchiveParts(readFile, manifest.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readArchiveFile(data, manifest.Files[0], manifest.Format, nil)
+	if err != nil || len(rows) != 40 {
+		t.Errorf("read %d journal rows back from S3 (%v), want 40", len(rows), err)
+	}
+}
+
+func TestS3ArchiverFlushFailsWhenUploadFails(t *testing.T) {
+	fake, server := newFakeS3(t, "archive")
+	fake.failPart = 1
+	archiver, err := newS3Archiver(testS3Config(t, server.URL), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small parts, so the file goes up with multipart upload
+	archiver.partSize = 8
+
+	columns := []string{"id"}
+	out, err := archiver.open("journal", columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.writeMember(out, columns, [][]any{{int64(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.writeManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := archiver.Flush(); err == nil {
+		t.Fatal("Flush succeeded although the upload failed")
+	}
+	if _, ok := fake.objects["cleanup/20250101_120000/manifest.json"]; ok {
+		t.Error("manifest was uploaded although a file upload failed")
+	}
+	if len(fake.aborted) != 1 {
+		t.Errorf("aborted uploads = %v, want one", fake.aborted)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// auditCheck is a read-only integrity query returning (table id, details) rows.
+// Query receives the filter that hides soft-deleted rows for a table alias.
+type auditCheck struct {
+	Name  string
+	Table string
+	Query func(alive func(alias string) string) string
+}
+
+var auditChecks = []auditCheck{
+	{
+		Name:  "journal_missing_detail",
+		Table: "journal",
+		Query: func(alive func(string) string) string {
+			return fmt.Sprintf(`
+				SELECT j.id, CONCAT('detailFk=', j.detailFk, ' accountFk=', j.accountFk)
+				FROM journal j
+				LEFT JOIN form_detail fd ON j.detailFk = fd.id AND %s
+				WHERE j.detailFk IS NOT NULL
+				  AND fd.id IS NULL
+				  AND %s
+				ORDER BY j.id
+			`, alive("fd"), alive("j"))
+		},
+	},
+	{
+		Name:  "journal_missing_reference",
+		Table: "journal",
+		Query: func(alive func(string) string) string {
+			return fmt.Sprintf(`
+				SELECT j.id, CONCAT('referenceFk=', j.referenceFk, ' accountFk=', j.accountFk)
+				FROM journal j
+				LEFT JOIN form_detail fd ON j.referenceFk = fd.id AND %s
+				WHERE j.referenceFk IS NOT NULL
+				  AND fd.id IS NULL
+				  AND %s
+				ORDER BY j.id
+			`, alive("fd"), alive("j"))
+		},
+	},
+	{
+		Name:  "detail_missing_header",
+		Table: "form_detail",
+		Query: func(alive func(string) string) string {
+			return fmt.Sprintf(`
+				SELECT fd.id, CONCAT('headerFk=', fd.headerFk)
+				FROM form_detail fd
+				LEFT JOIN form_header fh ON fd.headerFk = fh.id AND %s
+				WHERE fh.id IS NULL
+				  AND %s
+				ORDER BY fd.id
+			`, alive("fh"), alive("fd"))
+		},
+	},
+	{
+		Name:  "detail_quantity_mismatch",
+		Table: "form_detail",
+		Query: func(alive func(string) string) string {
+			return fmt.Sprintf(`
+				SELECT fd.id, CONCAT('quantity=', fd.quantity, ' journal_quantity=', %s)
+				FROM form_detail fd
+				INNER JOIN journal j ON j.detailFk = fd.id AND j.accountFk = 2 AND %s
+				WHERE %s
+				GROUP BY fd.id, fd.quantity
+				HAVING ABS(fd.quantity - (%s)) > 0.001
+				ORDER BY fd.id
+			`, detailJournalQuantity, alive("j"), alive("fd"), detailJournalQuantity)
+		},
+	},
+	{
+		Name:  "journal_invalid_type_or_quantity",
+		Table: "journal",
+		Query: func(alive func(string) string) string {
+			return fmt.Sprintf(`
+				SELECT j.id, CONCAT('type=', j.type, ' quantity=', j.quantity)
+				FROM journal j
+				WHERE (j.type NOT IN (-1, 1) OR j.quantity < 0)
+				  AND %s
+				ORDER BY j.id
+			`, alive("j"))
+		},
+	},
+	{
+		Name:  "negative_running_stock",
+		Table: "journal",
+		Query: func(alive func(string) string) string {
+			return fmt.Sprintf(`
+				SELECT 
+					MIN(r.id),
+					CONCAT('referenceFk=', r.referenceFk, ' itemFk=', r.itemFk, ' locationFk=', r.locationFk,
+						' shopFk=', r.shopFk, ' first_negative=', MIN(r.journalDate), ' min_balance=', MIN(r.running))
+				FROM (
+					SELECT 
+						id,
+						referenceFk,
+						itemFk,
+						locationFk,
+						shopFk,
+						journalDate,
+						SUM(type * quantity) OVER (PARTITION BY referenceFk, itemFk, locationFk, shopFk
+							ORDER BY journalDate, id) as running
+					FROM journal
+					WHERE accountFk = 2
+					  AND referenceFk IS NOT NULL
+					  AND %s
+				) r
+				WHERE r.running < -0.001
+				GROUP BY r.referenceFk, r.itemFk, r.locationFk, r.shopFk
+				ORDER BY MIN(r.id)
+			`, alive(""))
+		},
+	},
+}
+
+// RunAudit runs every integrity check without modifying any data
+func (cs *CleanupService) RunAudit() (*AuditReport, error) {
+	report := &AuditReport{
+		GeneratedAt: time.Now().Format("2006-01-02 15:04:05"),
+		Counts:      make(map[string]int),
+		Findings:    []AuditFinding{},
+	}
+
+	for _, check := range auditChecks {
+		rows, err := cs.conn().Query(check.Query(cs.notDeleted))
+		if err != nil {
+			return nil, fmt.Errorf("audit check %s: %v", check.Name, err)
+		}
+
+		count := 0
+		for rows.Next() {
+			finding := AuditFinding{Check: check.Name, Table: check.Table}
+			if err := rows.Scan(&finding.ID, &finding.Details); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			report.Findings = append(report.Findings, finding)
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		report.Counts[check.Name] = count
+		cs.logger.Printf("Audit check %s: %d findings", check.Name, count)
+	}
+
+	return report, nil
+}
+
+// WriteAuditTable writes the audit summary and findings as text tables
+func WriteAuditTable(w io.Writer, report *AuditReport) {
+	fmt.Fprintf(w, "\nIntegrity audit (%s):\n", report.GeneratedAt)
+	fmt.Fprintf(w, "%-34s %-10s\n", "Check", "Findings")
+	fmt.Fprintln(w, strings.Repeat("-", 45))
+	for _, check := range auditChecks {
+		fmt.Fprintf(w, "%-34s %-10d\n", check.Name, report.Counts[check.Name])
+	}
+
+	for _, check := range auditChecks {
+		if report.Counts[check.Name] == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", check.Name)
+		fmt.Fprintf(w, "%-12s %-10s %s\n", "Table", "ID", "Details")
+		fmt.Fprintln(w, strings.Repeat("-", 80))
+
+		count := 0
+		for _, finding := range report.Findings {
+			if finding.Check != check.Name {
+				continue
+			}
+			if count >= 20 {
+				fmt.Fprintf(w, "... and %d more records\n", report.Counts[check.Name]-20)
+				break
+			}
+			fmt.Fprintf(w, "%-12s %-10d %s\n", finding.Table, finding.ID, finding.Details)
+			count++
+		}
+	}
+}
+
+// WriteAuditJSON writes the full audit report as JSON
+func WriteAuditJSON(w io.Writer, report *AuditReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
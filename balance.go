@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FindBalances returns the current stock balance of every group with a non-zero balance,
+// positive and negative, ordered by shop, location and reference
+func (cs *CleanupService) FindBalances(filter BalanceFilter) ([]ItemBalance, error) {
+	return cs.BalancesAsOf(time.Time{}, filter)
+}
+
+// BalancesAsOf returns the stock balance of every group with a non-zero balance counting only
+// journal rows on or before asOf, like the cutoff of the cleanup. A zero asOf counts all rows.
+func (cs *CleanupService) BalancesAsOf(asOf time.Time, filter BalanceFilter) ([]ItemBalance, error) {
+	conditions := []string{"accountFk = 2", "referenceFk IS NOT NULL", cs.notDeleted("")}
+	var args []any
+	if !asOf.IsZero() {
+		conditions = append(conditions, "journalDate <= ?")
+		args = append(args, asOf.Format("2006-01-02"))
+	}
+	if len(filter.Shops) > 0 {
+		conditions = append(conditions, fmt.Sprintf("shopFk IN (%s)", joinIDs(filter.Shops)))
+	}
+	if len(filter.Locations) > 0 {
+		conditions = append(conditions, fmt.Sprintf("locationFk IN (%s)", joinIDs(filter.Locations)))
+	}
+	if len(filter.Items) > 0 {
+		conditions = append(conditions, fmt.Sprintf("itemFk IN (%s)", joinIDs(filter.Items)))
+	}
+
+	having := "SUM(type * quantity) <> 0"
+	if filter.NegativeOnly {
+		having = "SUM(type * quantity) < 0"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			referenceFk,
+			itemFk,
+			locationFk,
+			shopFk,
+			SUM(CASE WHEN type > 0 THEN quantity ELSE 0 END) as total_purchases,
+			SUM(CASE WHEN type < 0 THEN quantity ELSE 0 END) as total_sales,
+			SUM(type * quantity) as net_balance,
+			COUNT(*) as transaction_count,
+			MAX(journalDate) as last_txn_date
+		FROM journal
+		WHERE %s
+		GROUP BY referenceFk, itemFk, locationFk, shopFk
+		HAVING %s
+		ORDER BY shopFk, locationFk, referenceFk
+	`, strings.Join(conditions, "\n\t\t  AND "), having)
+
+	rows, err := cs.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []ItemBalance
+	for rows.Next() {
+		var balance ItemBalance
+		var lastTxnDate sql.NullString
+		err := rows.Scan(
+			&balance.ReferenceFk,
+			&balance.ItemFk,
+			&balance.LocationFk,
+			&balance.ShopFk,
+			&balance.TotalPurchases,
+			&balance.TotalSales,
+			&balance.NetBalance,
+			&balance.TxnCount,
+			&lastTxnDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if lastTxnDate.Valid {
+			balance.LastTxnDate = lastTxnDate.String
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, rows.Err()
+}
+
+// BalanceTotals sums the balance groups per shop, or per shop and location with byLocation set
+func BalanceTotals(balances []ItemBalance, byLocation bool) []BalanceTotal {
+	type totalKey struct{ shop, location int }
+	totals := make(map[totalKey]*BalanceTotal)
+	var keys []totalKey
+
+	for _, balance := range balances {
+		key := totalKey{shop: balance.ShopFk}
+		if byLocation {
+			key.location = balance.LocationFk
+		}
+		total, ok := totals[key]
+		if !ok {
+			total = &BalanceTotal{ShopFk: key.shop, LocationFk: key.location}
+			totals[key] = total
+			keys = append(keys, key)
+		}
+
+		total.Groups++
+		total.NetBalance += balance.NetBalance
+		if balance.NetBalance < 0 {
+			total.NegativeGroups++
+			total.NegativeBalance += balance.NetBalance
+		} else {
+			total.PositiveBalance += balance.NetBalance
+		}
+	}
+
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].shop != keys[b].shop {
+			return keys[a].shop < keys[b].shop
+		}
+		return keys[a].location < keys[b].location
+	})
+
+	result := make([]BalanceTotal, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *totals[key])
+	}
+	return result
+}
+
+// printBalanceRows lists balance groups, flagging negative stock
+func printBalanceRows(balances []ItemBalance, names *NameLookups) {
+	itemWidth := names.Width("item", 8)
+	locationWidth := names.Width("location", 10)
+	shopWidth := names.Width("shop", 8)
+
+	fmt.Printf("%-10s %-*s %-*s %-*s %-12s %-12s %-12s %-8s %-12s %s\n",
+		"RefFk", itemWidth, "Item", locationWidth, "Location", shopWidth, "Shop",
+		"Purchases", "Sales", "Balance", "TxnCount", "LastTxn", "Flag")
+	fmt.Println(strings.Repeat("-", 86+itemWidth+locationWidth+shopWidth))
+
+	for _, balance := range balances {
+		flag := ""
+		if balance.NetBalance < 0 {
+			flag = "NEGATIVE"
+		}
+		fmt.Printf("%-10d %-*s %-*s %-*s %-12.3f %-12.3f %-12.3f %-8d %-12s %s\n",
+			balance.ReferenceFk, itemWidth, names.Label("item", balance.ItemFk),
+			locationWidth, names.Label("location", balance.LocationFk), shopWidth, names.Label("shop", balance.ShopFk),
+			balance.TotalPurchases, balance.TotalSales, balance.NetBalance, balance.TxnCount,
+			dateOnly(balance.LastTxnDate), flag)
+	}
+}
+
+// printBalanceTotals lists balance totals per shop, or per shop and location
+func printBalanceTotals(totals []BalanceTotal, byLocation bool, names *NameLookups) {
+	shopWidth := names.Width("shop", 8)
+	locationWidth := 0
+	if byLocation {
+		locationWidth = names.Width("location", 10)
+		fmt.Printf("%-*s %-*s ", shopWidth, "Shop", locationWidth, "Location")
+	} else {
+		fmt.Printf("%-*s ", shopWidth, "Shop")
+	}
+	fmt.Printf("%-8s %-8s %-14s %-14s %-14s\n", "Groups", "Negative", "Positive", "NegativeQty", "Net")
+	fmt.Println(strings.Repeat("-", 64+shopWidth+locationWidth))
+
+	for _, total := range totals {
+		if byLocation {
+			fmt.Printf("%-*s %-*s ", shopWidth, names.Label("shop", total.ShopFk),
+				locationWidth, names.Label("location", total.LocationFk))
+		} else {
+			fmt.Printf("%-*s ", shopWidth, names.Label("shop", total.ShopFk))
+		}
+		fmt.Printf("%-8d %-8d %-14.3f %-14.3f %-14.3f\n",
+			total.Groups, total.NegativeGroups, total.PositiveBalance, total.NegativeBalance, total.NetBalance)
+	}
+}
+
+// ShowBalances displays one page of balance groups (pageSize 0 shows all),
+// followed by the totals per shop and per location over all groups
+func ShowBalances(balances []ItemBalance, names *NameLookups, page, pageSize int) {
+	if len(balances) == 0 {
+		fmt.Println("No groups with a non-zero balance found.")
+		return
+	}
+
+	start, end, page, pages := pageBounds(len(balances), page, pageSize)
+
+	negative := 0
+	for _, balance := range balances {
+		if balance.NetBalance < 0 {
+			negative++
+		}
+	}
+
+	fmt.Printf("\nBalance groups %d-%d of %d (page %d of %d):\n", start+1, end, len(balances), page, pages)
+	printBalanceRows(balances[start:end], names)
+	if page < pages {
+		fmt.Printf("... use --page %d for more, --page-size 0 for all\n", page+1)
+	}
+	if negative > 0 {
+		fmt.Printf("\n⚠️  %d groups have negative stock\n", negative)
+	}
+
+	fmt.Println("\nTotals per shop:")
+	printBalanceTotals(BalanceTotals(balances, false), false, names)
+	fmt.Println("\nTotals per shop and location:")
+	printBalanceTotals(BalanceTotals(balances, true), true, names)
+}
+
+// pageBounds returns the slice bounds of a page of total rows, the page clamped to the last one,
+// and the number of pages. A pageSize of 0 puts all rows on one page.
+func pageBounds(total, page, pageSize int) (int, int, int, int) {
+	if pageSize <= 0 || total == 0 {
+		return 0, total, 1, 1
+	}
+
+	pages := (total + pageSize - 1) / pageSize
+	if page > pages {
+		page = pages
+	}
+	start := (page - 1) * pageSize
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return start, end, page, pages
+}
+
+func (r *BalanceReport) info() reportInfo {
+	return reportInfo{
+		Title: "Stock balance report",
+		Fields: []reportField{
+			{"run_id", "Run", r.RunID},
+			{"as_of", "As of", r.AsOf},
+			{"filter", "Filter", r.Filter.String()},
+			{"generated_at", "Generated", r.GeneratedAt},
+		},
+	}
+}
+
+// tables converts the balances into the groups table and the totals per location.
+// The per-shop totals of both come with the report formats. Negative is 1 or 0, so it sums to
+// the negative group count in the per-shop totals and the XLSX subtotals.
+func (r *BalanceReport) tables(names *NameLookups) []reportTable {
+	balances := reportTable{
+		Name:  "balances",
+		Title: "Balance groups",
+		Sheet: "Balances",
+		Columns: []string{"ReferenceFk", "ItemFk", "LocationFk", "ShopFk", "TotalPurchases", "TotalSales",
+			"NetBalance", "TxnCount", "LastTxnDate", "Negative"},
+		ShopColumn: 3,
+		SumColumns: []int{6, 7, 9},
+	}
+	for _, b := range r.Balances {
+		negative := 0
+		if b.NetBalance < 0 {
+			negative = 1
+		}
+		balances.Rows = append(balances.Rows, []any{b.ReferenceFk, b.ItemFk, b.LocationFk, b.ShopFk,
+			b.TotalPurchases, b.TotalSales, b.NetBalance, b.TxnCount, dateOnly(b.LastTxnDate), negative})
+	}
+
+	locations := reportTable{
+		Name:  "location_totals",
+		Title: "Totals per location",
+		Sheet: "Location totals",
+		Columns: []string{"ShopFk", "LocationFk", "Groups", "NegativeGroups",
+			"PositiveBalance", "NegativeBalance", "NetBalance"},
+		ShopColumn: 0,
+		SumColumns: []int{2, 3, 4, 5, 6},
+	}
+	for _, t := range BalanceTotals(r.Balances, true) {
+		locations.Rows = append(locations.Rows, []any{t.ShopFk, t.LocationFk, t.Groups, t.NegativeGroups,
+			t.PositiveBalance, t.NegativeBalance, t.NetBalance})
+	}
+
+	return []reportTable{balances.withNames(names), locations.withNames(names)}
+}
+
+// WriteBalanceReport writes the balance report in each format to dir and returns the written files
+func WriteBalanceReport(report *BalanceReport, names *NameLookups, dir string, formats []string) ([]string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	names.loadBalances(report.Balances)
+	return writeReportFiles(filepath.Join(dir, "balance_"+report.RunID), report.info(), report.tables(names), formats)
+}
+
+// String describes the filter for report headers
+func (f BalanceFilter) String() string {
+	var parts []string
+	for _, part := range []struct {
+		label string
+		ids   []int
+	}{{"shop", f.Shops}, {"location", f.Locations}, {"item", f.Items}} {
+		if len(part.ids) > 0 {
+			parts = append(parts, part.label+" "+joinIDs(part.ids))
+		}
+	}
+	if f.NegativeOnly {
+		parts = append(parts, "negative only")
+	}
+	if len(parts) == 0 {
+		return "all groups"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ParseIDList parses a comma-separated list of ids, e.g. "3,7,12"
+func ParseIDList(spec string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPageBounds(t *testing.T) {
+	for _, tt := range []struct {
+		total, page, pageSize         int
+		start, end, wantPage, wantMax int
+	}{
+		{120, 1, 50, 0, 50, 1, 3},
+		{120, 3, 50, 100, 120, 3, 3},
+		{120, 9, 50, 100, 120, 3, 3},
+		{100, 2, 50, 50, 100, 2, 2},
+		{120, 2, 0, 0, 120, 1, 1},
+		{0, 4, 50, 0, 0, 1, 1},
+		{7, 1, 50, 0, 7, 1, 1},
+	} {
+		start, end, page, pages := pageBounds(tt.total, tt.page, tt.pageSize)
+		if start != tt.start || end != tt.end || page != tt.wantPage || pages != tt.wantMax {
+			t.Errorf("pageBounds(%d, %d, %d) = %d, %d, %d, %d, want %d, %d, %d, %d",
+				tt.total, tt.page, tt.pageSize, start, end, page, pages, tt.start, tt.end, tt.wantPage, tt.wantMax)
+		}
+	}
+}
+
+func TestParseIDList(t *testing.T) {
+	ids, err := ParseIDList(" 3, 7,,12 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{3, 7, 12}) {
+		t.Errorf("ParseIDList = %v, want [3 7 12]", ids)
+	}
+
+	for _, spec := range []string{"3,x", "-1", "1.5"} {
+		if _, err := ParseIDList(spec); err == nil || !strings.Contains(err.Error(), "invalid id") {
+			t.Errorf("ParseIDList(%q) error = %v, want invalid id", spec, err)
+		}
+	}
+}
+
+// testBalances are two groups in shop 1 (one negative) and one negative group in shop 2
+var testBalances = []ItemBalance{
+	{ReferenceFk: 1, ItemFk: 10, LocationFk: 5, ShopFk: 1, TotalPurchases: 10, TotalSales: 4, NetBalance: 6, TxnCount: 3},
+	{ReferenceFk: 2, ItemFk: 11, LocationFk: 6, ShopFk: 1, TotalPurchases: 1, TotalSales: 3.5, NetBalance: -2.5, TxnCount: 2},
+	{ReferenceFk: 3, ItemFk: 12, LocationFk: 7, ShopFk: 2, TotalPurchases: 0, TotalSales: 1, NetBalance: -1, TxnCount: 1},
+}
+
+func TestBalanceTotals(t *testing.T) {
+	got := BalanceTotals(testBalances, false)
+	want := []BalanceTotal{
+		{ShopFk: 1, Groups: 2, NegativeGroups: 1, PositiveBalance: 6, NegativeBalance: -2.5, NetBalance: 3.5},
+		{ShopFk: 2, Groups: 1, NegativeGroups: 1, NegativeBalance: -1, NetBalance: -1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BalanceTotals = %+v, want %+v", got, want)
+	}
+
+	if byLocation := BalanceTotals(testBalances, true); len(byLocation) != 3 || byLocation[1].LocationFk != 6 {
+		t.Errorf("BalanceTotals by location = %+v, want one total per location", byLocation)
+	}
+}
+
+func TestBalanceReportCountsNegativeGroupsPerShop(t *testing.T) {
+	report := &BalanceReport{RunID: "test", Balances: testBalances}
+	balances := report.tables(nil)[0]
+
+	negative := -1
+	for i, column := range balances.Columns {
+		if column == "Negative" {
+			negative = i
+		}
+	}
+	if negative < 0 {
+		t.Fatalf("columns %v have no Negative column", balances.Columns)
+	}
+	for i, row := range balances.Rows {
+		if _, ok := row[negative].(int); !ok {
+			t.Errorf("row %d: Negative is %T, want int", i, row[negative])
+		}
+	}
+
+	totals := balances.shopTotals()
+	want := map[int]int{1: 1, 2: 1}
+	for _, row := range totals.Rows {
+		shop := row[0].(int)
+		if got := row[len(row)-1]; got != want[shop] {
+			t.Errorf("shop %d: Negative total = %v, want %d", shop, got, want[shop])
+		}
+	}
+
+	sheet := xlsxSheet(balances)
+	if !strings.Contains(sheet, `<c r="J2" s="0"><v>0</v></c>`) || !strings.Contains(sheet, `<c r="J3" s="0"><v>1</v></c>`) {
+		t.Errorf("Negative cells are not written as numbers:\n%s", sheet)
+	}
+	if !strings.Contains(sheet, "SUBTOTAL(9,J2:J3)</f><v>1</v>") {
+		t.Errorf("missing Negative subtotal of shop 1:\n%s", sheet)
+	}
+}
@@ -4,24 +4,55 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 )
 
 type CleanupService struct {
-	db     *sql.DB
-	logger *log.Logger
+	db       *sql.DB
+	logger   *log.Logger
+	config   *Config
+	archiver Archiver
+	session  *sqlSession
+	names    *NameLookups
 }
 
-func NewCleanupService(db *sql.DB, logger *log.Logger) *CleanupService {
+func NewCleanupService(db *sql.DB, logger *log.Logger, config *Config) *CleanupService {
 	return &CleanupService{
-		db:     db,
-		logger: logger,
+		db:       db,
+		logger:   logger,
+		config:   config,
+		archiver: noArchiver{},
+		names:    NewNameLookups(db, logger, config),
 	}
 }
 
+// SetArchiver sets where hard-deleted rows are copied to; without one nothing is kept
+func (cs *CleanupService) SetArchiver(archiver Archiver) {
+	cs.archiver = archiver
+}
+
+// CheckArchive fails when ARCHIVE_TARGET is none for a step that must keep a copy of the rows it
+// changes. Inside a session nothing is committed, so no copy is needed.
+func (cs *CleanupService) CheckArchive(step string) error {
+	if cs.config.ArchiveTarget == "none" && cs.session == nil {
+		return fmt.Errorf("%s keeps a copy of the rows it changes, set ARCHIVE_TARGET to schema, database, file or s3", step)
+	}
+	return nil
+}
+
+// archiving reports whether changed rows are copied anywhere
+func (cs *CleanupService) archiving() bool {
+	_, none := cs.archiver.(noArchiver)
+	return !none
+}
+
+// Names returns the name lookups used by the listings
+func (cs *CleanupService) Names() *NameLookups {
+	return cs.names
+}
+
 func (cs *CleanupService) FindZeroBalanceItemsByDate(cutoffDate time.Time) ([]ItemBalance, error) {
-	query := `
+	query := fmt.Sprintf(`
 		SELECT 
 			j.referenceFk,
 			j.itemFk,
@@ -35,12 +66,13 @@ func (cs *CleanupService) FindZeroBalanceItemsByDate(cutoffDate time.Time) ([]It
 		WHERE j.accountFk = 2
 		  AND j.journalDate <= ?
 		  AND j.referenceFk IS NOT NULL
+		  AND %s
 		GROUP BY j.referenceFk, j.itemFk, j.locationFk, j.shopFk
 		HAVING SUM(j.type * j.quantity) = 0
 		ORDER BY j.referenceFk
-	`
+	`, cs.notDeleted("j"))
 
-	rows, err := cs.db.Query(query, cutoffDate.Format("2006-01-02"))
+	rows, err := cs.conn().Query(query, cutoffDate.Format("2006-01-02"))
 	if err != nil {
 		return nil, err
 	}
@@ -94,26 +126,46 @@ func (cs *CleanupService) GetRecordsToDelete(items []ItemBalance, cutoffDate tim
 	}
 
 	query := fmt.Sprintf(`
-		SELECT 
-			j.id as journal_id,
-			j.detailFk as detail_id,
-			fd.headerFk as header_id,
-			j.journalDate as txn_date
+		SELECT %s
 		FROM journal j
 		INNER JOIN form_detail fd ON j.detailFk = fd.id
 		INNER JOIN form_header fh ON fd.headerFk = fh.id
 		WHERE j.accountFk = 2
 		  AND j.referenceFk IN (%s)
 		  AND j.journalDate <= ?
+		  AND %s
+		  AND %s
+		  AND %s
 		ORDER BY j.referenceFk, j.journalDate
-	`, inClause)
+	`, deletedRecordColumns, inClause, cs.notDeleted("j"), cs.notDeleted("fd"), cs.notDeleted("fh"))
 
-	rows, err := cs.db.Query(query, cutoffDate.Format("2006-01-02"))
+	rows, err := cs.conn().Query(query, cutoffDate.Format("2006-01-02"))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanDeletedRecords(rows)
+}
+
+// deletedRecordColumns selects the DeletedRecord fields from journal j, form_detail fd and form_header fh
+const deletedRecordColumns = `
+			j.id as journal_id,
+			j.detailFk as detail_id,
+			fd.headerFk as header_id,
+			j.journalDate as txn_date,
+			j.referenceFk,
+			j.itemFk,
+			j.locationFk,
+			j.shopFk,
+			j.type,
+			j.quantity,
+			fh.partnerFk,
+			fh.formType,
+			fh.formDate`
+
+// scanDeletedRecords reads rows selected with deletedRecordColumns
+func scanDeletedRecords(rows *sql.Rows) ([]DeletedRecord, error) {
 	var records []DeletedRecord
 	for rows.Next() {
 		var record DeletedRecord
@@ -122,6 +174,15 @@ func (cs *CleanupService) GetRecordsToDelete(items []ItemBalance, cutoffDate tim
 			&record.DetailID,
 			&record.HeaderID,
 			&record.TxnDate,
+			&record.ReferenceFk,
+			&record.ItemFk,
+			&record.LocationFk,
+			&record.ShopFk,
+			&record.Type,
+			&record.Quantity,
+			&record.PartnerFk,
+			&record.FormType,
+			&record.FormDate,
 		)
 		if err != nil {
 			return nil, err
@@ -137,16 +198,23 @@ func (cs *CleanupService) PerformDeletion(records []DeletedRecord) error {
 		return nil
 	}
 
-	tx, err := cs.db.Begin()
+	tx, err := cs.begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	detailQuantities := make(map[int]float64)
 	journalIDsByDetail := make(map[int][]int)
+	headerSeen := make(map[int]bool)
+	var headerIDs []int
+	var removed []DeletedRecord
 	
 	for _, record := range records {
+		if !headerSeen[record.HeaderID] {
+			headerSeen[record.HeaderID] = true
+			headerIDs = append(headerIDs, record.HeaderID)
+		}
+
 		var quantity float64
 		var recType int
 		err := tx.QueryRow("SELECT quantity, type FROM journal WHERE id = ?", record.JournalID).Scan(&quantity, &recType)
@@ -155,10 +223,12 @@ func (cs *CleanupService) PerformDeletion(records []DeletedRecord) error {
 			return err
 		}
 		
-		actualQuantity := float64(recType) * quantity
-		detailQuantities[record.DetailID] += actualQuantity
+		record.Type = recType
+		record.Quantity = quantity
+		removed = append(removed, record)
 		journalIDsByDetail[record.DetailID] = append(journalIDsByDetail[record.DetailID], record.JournalID)
 	}
+	detailQuantities := recordReductions(removed)
 
 	var allJournalIDs []int
 	for _, ids := range journalIDsByDetail {
@@ -169,22 +239,51 @@ func (cs *CleanupService) PerformDeletion(records []DeletedRecord) error {
 	cs.logger.Printf("Deleting %d journal records: %v", len(allJournalIDs), allJournalIDs)
 	
 	if len(allJournalIDs) > 0 {
-		err = deleteByIDs(tx, "journal", allJournalIDs)
+		err = cs.deleteByIDs(tx, "journal", allJournalIDs)
 		if err != nil {
 			cs.logger.Printf("Error deleting journal records: %v", err)
 			return err
 		}
 	}
 
+	reducedDetails, err := cs.reduceDetailQuantities(tx, detailQuantities)
+	if err != nil {
+		return err
+	}
+
+	// Headers whose details were all deleted go in the same transaction
+	_, err = cs.deleteEmptiedHeaders(tx, headerIDs)
+	if err != nil {
+		return err
+	}
+
+	err = cs.recalculateTotals(tx, reducedDetails, headerIDs)
+	if err != nil {
+		return err
+	}
+
+	err = cs.commit(tx)
+	if err != nil {
+		cs.logger.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// reduceDetailQuantities subtracts the given quantity from each form_detail,
+// deleting the ones that reach zero. Returns the IDs of the updated details.
+func (cs *CleanupService) reduceDetailQuantities(tx dbExecutor, detailQuantities map[int]float64) ([]int, error) {
 	detailsToDelete := []int{}
-	detailsUpdated := 0
+	detailsUpdated := []int{}
+	newQuantities := make(map[int]float64)
 	
 	for detailID, reducedQty := range detailQuantities {
 		var currentQty float64
 		err := tx.QueryRow("SELECT quantity FROM form_detail WHERE id = ?", detailID).Scan(&currentQty)
 		if err != nil {
 			cs.logger.Printf("Error getting form_detail quantity for ID %d: %v", detailID, err)
-			return err
+			return nil, err
 		}
 		
 		newQty := currentQty - reducedQty
@@ -196,116 +295,82 @@ func (cs *CleanupService) PerformDeletion(records []DeletedRecord) error {
 			detailsToDelete = append(detailsToDelete, detailID)
 			cs.logger.Printf("form_detail ID %d will be deleted (qty would be %.3f)", detailID, newQty)
 		} else {
-			_, err := tx.Exec("UPDATE form_detail SET quantity = ? WHERE id = ?", newQty, detailID)
-			if err != nil {
-				cs.logger.Printf("Error updating form_detail ID %d: %v", detailID, err)
-				return err
-			}
-			detailsUpdated++
-			cs.logger.Printf("form_detail ID %d updated: new quantity = %.3f", detailID, newQty)
+			detailsUpdated = append(detailsUpdated, detailID)
+			newQuantities[detailID] = newQty
+		}
+	}
+
+	// Keep the previous quantities, so restore can set them back
+	err := cs.archiveUpdates(tx, "form_detail", detailsUpdated)
+	if err != nil {
+		cs.logger.Printf("Error archiving form_detail records: %v", err)
+		return nil, err
+	}
+	for _, detailID := range detailsUpdated {
+		_, err := tx.Exec("UPDATE form_detail SET quantity = ? WHERE id = ?", newQuantities[detailID], detailID)
+		if err != nil {
+			cs.logger.Printf("Error updating form_detail ID %d: %v", detailID, err)
+			return nil, err
 		}
+		cs.logger.Printf("form_detail ID %d updated: new quantity = %.3f", detailID, newQuantities[detailID])
 	}
 
 	if len(detailsToDelete) > 0 {
 		fmt.Printf("Deleting %d form_detail records with zero quantity...\n", len(detailsToDelete))
 		cs.logger.Printf("Deleting %d form_detail records: %v", len(detailsToDelete), detailsToDelete)
 		
-		err = deleteByIDs(tx, "form_detail", detailsToDelete)
+		err := cs.deleteByIDs(tx, "form_detail", detailsToDelete)
 		if err != nil {
 			cs.logger.Printf("Error deleting form_detail records: %v", err)
-			return err
+			return nil, err
 		}
 	}
 	
-	if detailsUpdated > 0 {
-		fmt.Printf("Updated %d form_detail records with reduced quantities\n", detailsUpdated)
-		cs.logger.Printf("Updated %d form_detail records with reduced quantities", detailsUpdated)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		cs.logger.Printf("Error committing transaction: %v", err)
-		return err
+	if len(detailsUpdated) > 0 {
+		fmt.Printf("Updated %d form_detail records with reduced quantities\n", len(detailsUpdated))
+		cs.logger.Printf("Updated %d form_detail records with reduced quantities", len(detailsUpdated))
 	}
 
-	return nil
+	return detailsUpdated, nil
 }
 
 func (cs *CleanupService) ShowRemainingBalance() error {
-	query := `
-		SELECT 
-			referenceFk,
-			itemFk,
-			locationFk,
-			shopFk,
-			SUM(CASE WHEN type > 0 THEN quantity ELSE 0 END) as total_purchases,
-			SUM(CASE WHEN type < 0 THEN quantity ELSE 0 END) as total_sales,
-			SUM(type * quantity) as net_balance,
-			COUNT(*) as transaction_count
-		FROM journal
-		WHERE accountFk = 2 
-		  AND referenceFk IS NOT NULL
-		GROUP BY referenceFk, itemFk, locationFk, shopFk
-		HAVING SUM(type * quantity) > 0
-		ORDER BY referenceFk
-		LIMIT 10
-	`
-
-	rows, err := cs.db.Query(query)
+	balances, err := cs.FindBalances(BalanceFilter{})
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
-	fmt.Println("\nRemaining items with positive balance (first 10):")
-	fmt.Printf("%-10s %-8s %-10s %-8s %-12s %-12s %-12s %-8s\n", 
-		"RefFk", "ItemFk", "LocationFk", "ShopFk", "Purchases", "Sales", "Balance", "TxnCount")
-	fmt.Println(strings.Repeat("-", 90))
-
-	count := 0
-	for rows.Next() {
-		var referenceFk, itemFk, locationFk, shopFk, txnCount int
-		var totalPurchases, totalSales, netBalance float64
-		
-		err := rows.Scan(
-			&referenceFk, &itemFk, &locationFk, &shopFk,
-			&totalPurchases, &totalSales, &netBalance, &txnCount,
-		)
-		if err != nil {
-			return err
+	var positive []ItemBalance
+	negative := 0
+	for _, balance := range balances {
+		if balance.NetBalance > 0 {
+			positive = append(positive, balance)
+		} else {
+			negative++
 		}
-
-		fmt.Printf("%-10d %-8d %-10d %-8d %-12.3f %-12.3f %-12.3f %-8d\n",
-			referenceFk, itemFk, locationFk, shopFk,
-			totalPurchases, totalSales, netBalance, txnCount)
-		count++
 	}
 
-	if count == 0 {
+	fmt.Println("\nRemaining items with positive balance (first 10):")
+	if len(positive) > 10 {
+		printBalanceRows(positive[:10], cs.names)
+	} else {
+		printBalanceRows(positive, cs.names)
+	}
+	if len(positive) == 0 {
 		fmt.Println("No items with positive balance found.")
 	}
 
-	var totalItems int
-	err = cs.db.QueryRow(`
-		SELECT COUNT(*) FROM (
-			SELECT referenceFk
-			FROM journal
-			WHERE accountFk = 2 
-			  AND referenceFk IS NOT NULL
-			GROUP BY referenceFk, itemFk, locationFk, shopFk
-			HAVING SUM(type * quantity) > 0
-		) as temp
-	`).Scan(&totalItems)
-	
-	if err == nil {
-		fmt.Printf("\nTotal reference items with positive balance: %d\n", totalItems)
+	fmt.Printf("\nTotal reference items with positive balance: %d\n", len(positive))
+	if negative > 0 {
+		fmt.Printf("⚠️  Groups with negative balance: %d (list them with: report balance --negative)\n", negative)
+		cs.logger.Printf("%d groups have a negative balance", negative)
 	}
 
-	return rows.Err()
+	return nil
 }
 
 func (cs *CleanupService) FindOrphanedHeaders() ([]OrphanedHeader, error) {
-	query := `
+	query := fmt.Sprintf(`
 		SELECT 
 			fh.id,
 			fh.headerNo,
@@ -313,12 +378,13 @@ func (cs *CleanupService) FindOrphanedHeaders() ([]OrphanedHeader, error) {
 			fh.partnerFk,
 			fh.formType
 		FROM form_header fh
-		LEFT JOIN form_detail fd ON fh.id = fd.headerFk
+		LEFT JOIN form_detail fd ON fh.id = fd.headerFk AND %s
 		WHERE fd.id IS NULL
+		  AND %s
 		ORDER BY fh.id
-	`
+	`, cs.notDeleted("fd"), cs.notDeleted("fh"))
 
-	rows, err := cs.db.Query(query)
+	rows, err := cs.conn().Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -339,8 +405,57 @@ func (cs *CleanupService) FindOrphanedHeaders() ([]OrphanedHeader, error) {
 		}
 		headers = append(headers, header)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return headers, cs.loadHeaderItems(headers)
+}
+
+// loadHeaderItems sets the items of each header's former details, read from the journal rows
+// still linked to them. Soft-deleted rows count too; after a hard delete nothing is left.
+func (cs *CleanupService) loadHeaderItems(headers []OrphanedHeader) error {
+	index := make(map[int]int, len(headers))
+	var headerIDs []int
+	for i, header := range headers {
+		index[header.ID] = i
+		headerIDs = append(headerIDs, header.ID)
+	}
+
+	batchSize := 1000
+	for i := 0; i < len(headerIDs); i += batchSize {
+		end := i + batchSize
+		if end > len(headerIDs) {
+			end = len(headerIDs)
+		}
 
-	return headers, rows.Err()
+		rows, err := cs.conn().Query(fmt.Sprintf(`
+			SELECT DISTINCT fd.headerFk, j.itemFk
+			FROM form_detail fd
+			JOIN journal j ON j.detailFk = fd.id
+			WHERE fd.headerFk IN (%s)
+			ORDER BY fd.headerFk, j.itemFk
+		`, joinIDs(headerIDs[i:end])))
+		if err != nil {
+			return fmt.Errorf("error reading items of orphaned headers: %v", err)
+		}
+		for rows.Next() {
+			var headerID, itemFk int
+			if err := rows.Scan(&headerID, &itemFk); err != nil {
+				rows.Close()
+				return fmt.Errorf("error reading items of orphaned headers: %v", err)
+			}
+			header := &headers[index[headerID]]
+			header.ItemFks = append(header.ItemFks, itemFk)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("error reading items of orphaned headers: %v", err)
+		}
+	}
+
+	return nil
 }
 
 func (cs *CleanupService) DeleteOrphanedHeaders(headers []OrphanedHeader) error {
@@ -348,7 +463,7 @@ func (cs *CleanupService) DeleteOrphanedHeaders(headers []OrphanedHeader) error
 		return nil
 	}
 
-	tx, err := cs.db.Begin()
+	tx, err := cs.begin()
 	if err != nil {
 		return err
 	}
@@ -362,13 +477,13 @@ func (cs *CleanupService) DeleteOrphanedHeaders(headers []OrphanedHeader) error
 	fmt.Printf("Deleting %d orphaned form_header records...\n", len(headerIDs))
 	cs.logger.Printf("Deleting %d orphaned form_header records: %v", len(headerIDs), headerIDs)
 
-	err = deleteByIDs(tx, "form_header", headerIDs)
+	err = cs.deleteByIDs(tx, "form_header", headerIDs)
 	if err != nil {
 		cs.logger.Printf("Error deleting orphaned headers: %v", err)
 		return err
 	}
 
-	err = tx.Commit()
+	err = cs.commit(tx)
 	if err != nil {
 		cs.logger.Printf("Error committing transaction: %v", err)
 		return err
@@ -377,38 +492,51 @@ func (cs *CleanupService) DeleteOrphanedHeaders(headers []OrphanedHeader) error
 	return nil
 }
 
-func (cs *CleanupService) FindZeroQuantityDetails() ([]int, error) {
-	query := `
-		SELECT id 
-		FROM form_detail 
-		WHERE quantity <= 0.001
-		ORDER BY id
-	`
-
-	rows, err := cs.db.Query(query)
+func (cs *CleanupService) FindZeroQuantityDetails() ([]ZeroQuantityDetail, error) {
+	query := fmt.Sprintf(`
+		SELECT 
+			fd.id,
+			fd.headerFk,
+			COALESCE(fh.partnerFk, 0),
+			COALESCE((SELECT MIN(j.itemFk) FROM journal j WHERE j.detailFk = fd.id), 0),
+			COALESCE(fh.formDate, '')
+		FROM form_detail fd
+		LEFT JOIN form_header fh ON fd.headerFk = fh.id
+		WHERE fd.quantity <= 0.001
+		  AND %s
+		ORDER BY fd.id
+	`, cs.notDeleted("fd"))
+
+	rows, err := cs.conn().Query(query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var ids []int
+	var details []ZeroQuantityDetail
 	for rows.Next() {
-		var id int
-		if err := rows.Scan(&id); err != nil {
+		var detail ZeroQuantityDetail
+		err := rows.Scan(&detail.ID, &detail.HeaderID, &detail.PartnerFk, &detail.ItemFk, &detail.FormDate)
+		if err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
+		details = append(details, detail)
 	}
 
-	return ids, rows.Err()
+	return details, rows.Err()
 }
 
-func (cs *CleanupService) DeleteZeroQuantityDetails(ids []int) error {
-	if len(ids) == 0 {
+func (cs *CleanupService) DeleteZeroQuantityDetails(details []ZeroQuantityDetail) error {
+	if len(details) == 0 {
 		return nil
 	}
 
-	tx, err := cs.db.Begin()
+	var ids []int
+	for _, detail := range details {
+		ids = append(ids, detail.ID)
+	}
+
+	tx, err := cs.begin()
 	if err != nil {
 		return err
 	}
@@ -417,13 +545,13 @@ func (cs *CleanupService) DeleteZeroQuantityDetails(ids []int) error {
 	fmt.Printf("Deleting %d zero-quantity form_detail records...\n", len(ids))
 	cs.logger.Printf("Deleting %d zero-quantity form_detail records: %v", len(ids), ids)
 
-	err = deleteByIDs(tx, "form_detail", ids)
+	err = cs.deleteByIDs(tx, "form_detail", ids)
 	if err != nil {
 		cs.logger.Printf("Error deleting zero-quantity form_detail: %v", err)
 		return err
 	}
 
-	err = tx.Commit()
+	err = cs.commit(tx)
 	if err != nil {
 		cs.logger.Printf("Error committing transaction: %v", err)
 		return err
@@ -451,7 +579,8 @@ func buildWhereClause(items []ItemBalance) string {
 	return whereClause
 }
 
-func deleteByIDs(tx *sql.Tx, tableName string, ids []int) error {
+// deleteByIDs archives and deletes rows in batches, or marks them deleted in soft-delete mode
+func (cs *CleanupService) deleteByIDs(tx dbExecutor, tableName string, ids []int) error {
 	if len(ids) == 0 {
 		return nil
 	}
@@ -472,8 +601,96 @@ func deleteByIDs(tx *sql.Tx, tableName string, ids []int) error {
 			inClause += fmt.Sprintf("%d", id)
 		}
 
+		if cs.config.SoftDelete {
+			query, args := cs.softDeleteQuery(tableName, inClause)
+			_, err := tx.Exec(query, args...)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := cs.archiver.Archive(tx, tableName, batch)
+		if err != nil {
+			return err
+		}
+
 		query := fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", tableName, inClause)
-		_, err := tx.Exec(query)
+		_, err = tx.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveUpdates copies rows about to be updated to ARCHIVE_TARGET in batches, also in
+// soft-delete mode, so restore can set them back to their previous values
+func (cs *CleanupService) archiveUpdates(tx dbExecutor, tableName string, ids []int) error {
+	batchSize := 1000
+	for i := 0; i < len(ids); i += batchSize {
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		err := cs.archiver.Archive(tx, tableName, ids[i:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commit flushes the archive and commits the transaction, so rows are only deleted once archived
+func (cs *CleanupService) commit(tx dbTx) error {
+	err := cs.archiver.Flush()
+	if err != nil {
+		return fmt.Errorf("archive: %v", err)
+	}
+	return tx.Commit()
+}
+
+// createArchiveTable creates <table>_archive from the source columns when missing.
+// It must not run inside a data transaction: MySQL commits the open transaction on DDL.
+func createArchiveTable(db dbExecutor, tableName string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s_archive AS
+		SELECT t.*, CAST(NULL AS CHAR(32)) as archiveRunId, NOW() as archivedAt
+		FROM %s t
+		WHERE 1 = 0
+	`, tableName, tableName))
+	return err
+}
+
+// archiveByIDs copies rows into <table>_archive, tagged with the run ID, before they are changed.
+// The archive table must exist, see createArchiveTable.
+func archiveByIDs(tx dbExecutor, tableName string, ids []int, runID string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	batchSize := 1000
+	for i := 0; i < len(ids); i += batchSize {
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch := ids[i:end]
+		inClause := ""
+		for j, id := range batch {
+			if j > 0 {
+				inClause += ","
+			}
+			inClause += fmt.Sprintf("%d", id)
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s_archive SELECT t.*, ?, NOW() FROM %s t WHERE t.id IN (%s)",
+			tableName, tableName, inClause)
+		_, err := tx.Exec(query, runID)
 		if err != nil {
 			return err
 		}
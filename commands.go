@@ -0,0 +1,342 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// runAudit reports journal/form_detail/form_header inconsistencies without deleting anything
+func runAudit(cleanupService *CleanupService, logger *log.Logger, args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	format := flags.String("format", "table", "output format: table or json")
+	output := flags.String("output", "", "write the report to this file instead of stdout")
+	flags.Parse(args)
+
+	if *format != "table" && *format != "json" {
+		log.Fatalf("Unknown audit format %q (use table or json)", *format)
+	}
+
+	logger.Println("Starting integrity audit")
+	report, err := cleanupService.RunAudit()
+	if err != nil {
+		log.Fatal("Error running audit:", err)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatal("Error creating audit output:", err)
+		}
+		defer out.Close()
+	}
+
+	if *format == "json" {
+		err = WriteAuditJSON(out, report)
+		if err != nil {
+			log.Fatal("Error writing audit report:", err)
+		}
+	} else {
+		WriteAuditTable(out, report)
+	}
+
+	if *output != "" {
+		fmt.Printf("Audit report written to %s (%d findings)\n", *output, len(report.Findings))
+	}
+	logger.Printf("Integrity audit completed with %d findings", len(report.Findings))
+}
+
+// runRepair runs a repair operation, showing the changes in dry run mode
+func runRepair(config *Config, cleanupService *CleanupService, logger *log.Logger, args []string) {
+	if len(args) == 0 || args[0] != "form-detail-quantity" {
+		log.Fatal("Usage: repair form-detail-quantity")
+	}
+
+	fmt.Println("\n=== REPAIR: form_detail quantity from journal ===")
+	logger.Printf("Starting form_detail quantity repair, DryRun: %v", config.DryRun)
+
+	repairs, err := cleanupService.FindQuantityRepairs()
+	if err != nil {
+		log.Fatal("Error finding form_detail quantity differences:", err)
+	}
+
+	fmt.Printf("Found %d form_detail records whose quantity differs from the journal\n", len(repairs))
+	logger.Printf("Found %d form_detail quantity differences", len(repairs))
+
+	if len(repairs) == 0 {
+		return
+	}
+
+	if config.DryRun {
+		fmt.Println("\n=== DRY RUN MODE - No actual changes will occur ===")
+		ShowQuantityRepairs(repairs)
+		for _, repair := range repairs {
+			logger.Printf("form_detail ID %d: current_qty=%.3f, journal_qty=%.3f",
+				repair.DetailID, repair.OldQuantity, repair.NewQuantity)
+		}
+		logger.Println("Dry run for form_detail quantity repair completed")
+		return
+	}
+
+	err = cleanupService.ApplyQuantityRepairs(repairs)
+	if err != nil {
+		log.Fatal("Error repairing form_detail quantities:", err)
+	}
+
+	fmt.Println("form_detail quantity repair completed successfully!")
+	logger.Printf("form_detail quantity repair completed. Repaired %d records", len(repairs))
+}
+
+// runPurge hard-deletes rows that were soft-deleted more than --days days ago
+func runPurge(config *Config, cleanupService *CleanupService, logger *log.Logger, args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	days := flags.Int("days", config.PurgeAfterDays, "purge rows soft-deleted more than this many days ago")
+	flags.Parse(args)
+
+	if *days < 0 {
+		log.Fatal("--days must not be negative")
+	}
+
+	fmt.Printf("\n=== PURGE: rows soft-deleted more than %d days ago ===\n", *days)
+	logger.Printf("Starting purge of rows soft-deleted more than %d days ago, DryRun: %v", *days, config.DryRun)
+
+	counts, err := cleanupService.CountPurgeable(*days)
+	if err != nil {
+		log.Fatal("Error counting soft-deleted rows:", err)
+	}
+
+	total := 0
+	for _, table := range purgeTables {
+		fmt.Printf("  %-12s %d rows\n", table, counts[table])
+		logger.Printf("Purgeable %s rows: %d", table, counts[table])
+		total += counts[table]
+	}
+
+	if total == 0 {
+		return
+	}
+
+	if config.DryRun {
+		fmt.Println("\n=== DRY RUN MODE - No actual purge will occur ===")
+		logger.Println("Dry run for purge completed")
+		return
+	}
+
+	purged, err := cleanupService.PurgeSoftDeleted(*days)
+	if err != nil {
+		log.Fatal("Error purging soft-deleted rows:", err)
+	}
+
+	fmt.Printf("Purged %d journal, %d form_detail and %d form_header rows\n",
+		purged["journal"], purged["form_detail"], purged["form_header"])
+	logger.Printf("Purge completed. Purged %d journal, %d form_detail and %d form_header rows",
+		purged["journal"], purged["form_detail"], purged["form_header"])
+}
+
+// runRestore puts the rows of an archive run, a local directory or s3:// prefix, back into production
+func runRestore(config *Config, cleanupService *CleanupService, logger *log.Logger, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Usage: restore <archive run directory | s3://bucket/prefix/<run id>>\n" +
+			"Re-inserts the deleted rows and sets updated rows back to their archived values; rows soft-deleted by the run stay soft-deleted")
+	}
+	dir := args[0]
+
+	fmt.Printf("\n=== RESTORE: %s ===\n", dir)
+	logger.Printf("Starting restore from %s, DryRun: %v", dir, config.DryRun)
+
+	manifest, tables, err := cleanupService.ReadArchive(dir)
+	if err != nil {
+		log.Fatal("Error reading archive:", err)
+	}
+
+	fmt.Printf("Archive run %s (%s", manifest.RunID, manifest.Format)
+	if manifest.Encryption != "" {
+		fmt.Printf(", %s, key %s", manifest.Encryption, manifest.KeyFingerprint)
+	}
+	fmt.Println("), checksums verified")
+	for _, table := range tables {
+		fmt.Printf("  %-12s %d rows\n", table.Table, len(table.Rows))
+		logger.Printf("Archived %s rows: %d", table.Table, len(table.Rows))
+	}
+
+	if config.DryRun {
+		fmt.Println("\n=== DRY RUN MODE - No rows will be restored ===")
+		logger.Println("Dry run for restore completed")
+		return
+	}
+
+	err = cleanupService.RestoreArchive(tables)
+	if err != nil {
+		log.Fatal("Error restoring archive:", err)
+	}
+
+	fmt.Println("Restore completed successfully!")
+	logger.Printf("Restore from %s completed", dir)
+}
+
+// runReport runs a read-only report
+func runReport(config *Config, cleanupService *CleanupService, logger *log.Logger, args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: report balance|aging [flags]")
+	}
+
+	switch args[0] {
+	case "balance":
+		runBalanceReport(config, cleanupService, logger, args[1:])
+	case "aging":
+		runAgingReport(config, cleanupService, logger, args[1:])
+	default:
+		log.Fatalf("Unknown report %q (use balance or aging)", args[0])
+	}
+}
+
+// reportFlags are the group filter, paging and export flags shared by the reports
+type reportFlags struct {
+	shops        *string
+	locations    *string
+	items        *string
+	page         *int
+	pageSize     *int
+	reportFormat *string
+	reportDir    *string
+}
+
+func newReportFlags(flags *flag.FlagSet) *reportFlags {
+	return &reportFlags{
+		shops:        flags.String("shop", "", "only these shopFk ids (comma-separated)"),
+		locations:    flags.String("location", "", "only these locationFk ids (comma-separated)"),
+		items:        flags.String("item", "", "only these itemFk ids (comma-separated)"),
+		page:         flags.Int("page", 1, "page of groups to show"),
+		pageSize:     flags.Int("page-size", 50, "groups per page, 0 for all"),
+		reportFormat: flags.String("report-format", "", "also write the report as csv, json, html and/or xlsx (comma-separated)"),
+		reportDir:    flags.String("report-dir", ".", "directory for the --report-format files"),
+	}
+}
+
+// parse validates the parsed flags and returns the group filter and the report formats
+func (f *reportFlags) parse() (BalanceFilter, []string) {
+	var filter BalanceFilter
+	var err error
+	for _, list := range []struct {
+		name string
+		spec string
+		ids  *[]int
+	}{{"--shop", *f.shops, &filter.Shops}, {"--location", *f.locations, &filter.Locations}, {"--item", *f.items, &filter.Items}} {
+		*list.ids, err = ParseIDList(list.spec)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", list.name, err)
+		}
+	}
+
+	if *f.page < 1 || *f.pageSize < 0 {
+		log.Fatal("--page must be at least 1 and --page-size must not be negative")
+	}
+	formats, err := ParseReportFormats(*f.reportFormat)
+	if err != nil {
+		log.Fatal("Invalid --report-format:", err)
+	}
+	return filter, formats
+}
+
+// printReportFiles lists the files written by a report
+func printReportFiles(logger *log.Logger, title string, files []string) {
+	fmt.Printf("\n%s:\n", title)
+	for _, file := range files {
+		fmt.Printf("  %s\n", file)
+	}
+	logger.Printf("%s written: %s", title, strings.Join(files, ", "))
+}
+
+// runBalanceReport lists the stock position of all groups with a non-zero balance
+func runBalanceReport(config *Config, cleanupService *CleanupService, logger *log.Logger, args []string) {
+	flags := flag.NewFlagSet("report balance", flag.ExitOnError)
+	common := newReportFlags(flags)
+	negativeOnly := flags.Bool("negative", false, "only groups with negative stock")
+	asOf := flags.String("as-of", "", "balance as of this date (YYYY-MM-DD), counting journal rows on or before it")
+	flags.Parse(args)
+
+	filter, formats := common.parse()
+	filter.NegativeOnly = *negativeOnly
+
+	var asOfDate time.Time
+	var err error
+	asOfLabel := "current"
+	if *asOf != "" {
+		asOfDate, err = time.Parse("2006-01-02", *asOf)
+		if err != nil {
+			log.Fatalf("Invalid --as-of %q (use YYYY-MM-DD)", *asOf)
+		}
+		asOfLabel = asOfDate.Format("2006-01-02")
+	}
+
+	fmt.Printf("\n=== REPORT: stock balance as of %s (%s) ===\n", asOfLabel, filter)
+	logger.Printf("Starting balance report as of %s (%s)", asOfLabel, filter)
+
+	balances, err := cleanupService.BalancesAsOf(asOfDate, filter)
+	if err != nil {
+		log.Fatal("Error finding balances:", err)
+	}
+	cleanupService.Names().loadBalances(balances)
+	ShowBalances(balances, cleanupService.Names(), *common.page, *common.pageSize)
+	logger.Printf("Found %d groups with a non-zero balance", len(balances))
+
+	if len(formats) > 0 {
+		report := &BalanceReport{
+			RunID:       config.RunID,
+			GeneratedAt: time.Now().Format("2006-01-02 15:04:05"),
+			AsOf:        asOfLabel,
+			Filter:      filter,
+			Balances:    balances,
+		}
+		files, err := WriteBalanceReport(report, cleanupService.Names(), *common.reportDir, formats)
+		if err != nil {
+			log.Fatal("Error writing balance report:", err)
+		}
+		printReportFiles(logger, "Balance report", files)
+	}
+}
+
+// runAgingReport lists the groups with positive balance and no movement for at least --days days by age
+func runAgingReport(config *Config, cleanupService *CleanupService, logger *log.Logger, args []string) {
+	flags := flag.NewFlagSet("report aging", flag.ExitOnError)
+	common := newReportFlags(flags)
+	days := flags.Int("days", 0, "only groups without movement for at least this many days")
+	flags.Parse(args)
+
+	filter, formats := common.parse()
+	if *days < 0 {
+		log.Fatal("--days must not be negative")
+	}
+
+	fmt.Printf("\n=== REPORT: stock without movement for %d days or more (%s) ===\n", *days, filter)
+	logger.Printf("Starting aging report, %d days (%s)", *days, filter)
+
+	now := time.Now()
+	stock, err := cleanupService.FindAgedStock(now, *days, filter)
+	if err != nil {
+		log.Fatal("Error finding aged stock:", err)
+	}
+
+	cleanupService.Names().loadBalances(agedBalances(stock))
+	ShowAgedStock(stock, cleanupService.Names(), *common.page, *common.pageSize)
+	logger.Printf("Found %d groups with positive balance and no movement for %d days", len(stock), *days)
+
+	if len(formats) > 0 {
+		report := &AgingReport{
+			RunID:       config.RunID,
+			GeneratedAt: now.Format("2006-01-02 15:04:05"),
+			MinDays:     *days,
+			Filter:      filter,
+			Stock:       stock,
+		}
+		files, err := WriteAgingReport(report, cleanupService.Names(), *common.reportDir, formats)
+		if err != nil {
+			log.Fatal("Error writing aging report:", err)
+		}
+		printReportFiles(logger, "Aging report", files)
+	}
+}
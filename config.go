@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,7 +17,66 @@ type Config struct {
 	DBName     string
 	CutoffDate string
 	DryRun     bool
+	Simulate   bool
 	LogFile    string
+	RunID      string
+
+	// Cutoff expression settings
+	FiscalYearStartMonth int
+	PeriodLockTable      string
+	PeriodLockColumn     string
+
+	// Zero-balance retention rule (0 disables)
+	RetainLastRows   int
+	RetainLastMonths int
+
+	// Legal hold sources (empty disables)
+	LegalHoldTable string
+	LegalHoldFile  string
+
+	// Retention policy by form_header.formType
+	RetentionPolicy  string
+	RetentionDefault string
+	ComplianceReport string
+
+	// Cleanup mode for groups with non-zero balance at the cutoff (empty disables)
+	MatchingMode string
+
+	// Recalculation of quantity-derived columns after a quantity reduction
+	DetailRecalcRules []RecalcRule
+	HeaderRecalcRules []RecalcRule
+
+	// Soft delete: mark rows instead of deleting them, purge them later
+	SoftDelete           bool
+	SoftDeleteColumn     string
+	SoftDeleteFlagColumn string
+	SoftDeleteRunColumn  string
+	PurgeAfterDays       int
+
+	// Destination of hard-deleted rows: none, schema, database, file or s3
+	ArchiveTarget     string
+	ArchiveDir        string
+	ArchiveFormat     string
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3Prefix          string
+	S3AccessKey       string
+	S3SecretKey       string
+	S3PartSizeMB      int
+	ArchiveKey        string
+	ArchiveKeyFile    string
+	ArchiveDBHost     string
+	ArchiveDBPort     string
+	ArchiveDBUser     string
+	ArchiveDBPassword string
+	ArchiveDBName     string
+
+	// Name lookups for the foreign keys shown in listings and reports (nil disables)
+	ItemLookup     *NameLookup
+	LocationLookup *NameLookup
+	ShopLookup     *NameLookup
+	PartnerLookup  *NameLookup
 }
 
 // LoadConfig loads configuration from .env file and environment variables
@@ -40,6 +100,127 @@ func LoadConfig() (*Config, error) {
 		CutoffDate: getEnv("CUTOFF_DATE", "2024-01-01"),
 		DryRun:     getEnv("DRY_RUN", "false") == "true",
 		LogFile:    getEnv("LOG_FILE", defaultLogFile),
+		RunID:      currentTime.Format("20060102_150405"),
+	}
+
+	// Simulate is a dry run for every command except cleanup, which runs and rolls back
+	switch getEnv("DRY_RUN", "false") {
+	case "true", "false":
+	case "simulate":
+		config.DryRun = true
+		config.Simulate = true
+	default:
+		return nil, fmt.Errorf("invalid DRY_RUN %q (use true, false or simulate)", getEnv("DRY_RUN", "false"))
+	}
+
+	config.FiscalYearStartMonth, err = getEnvInt("FISCAL_YEAR_START_MONTH", 1)
+	if err != nil {
+		return nil, err
+	}
+	if config.FiscalYearStartMonth < 1 || config.FiscalYearStartMonth > 12 {
+		return nil, fmt.Errorf("FISCAL_YEAR_START_MONTH must be between 1 and 12")
+	}
+	config.PeriodLockTable = getEnv("PERIOD_LOCK_TABLE", "period_lock")
+	config.PeriodLockColumn = getEnv("PERIOD_LOCK_COLUMN", "closedUntil")
+
+	config.RetainLastRows, err = getEnvInt("RETAIN_LAST_ROWS", 0)
+	if err != nil {
+		return nil, err
+	}
+	config.RetainLastMonths, err = getEnvInt("RETAIN_LAST_MONTHS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	config.LegalHoldTable = getEnv("LEGAL_HOLD_TABLE", "")
+	config.LegalHoldFile = getEnv("LEGAL_HOLD_FILE", "")
+
+	config.RetentionPolicy = getEnv("RETENTION_POLICY", "")
+	config.RetentionDefault = getEnv("RETENTION_DEFAULT", "")
+	config.ComplianceReport = getEnv("COMPLIANCE_REPORT",
+		fmt.Sprintf("compliance_%s.csv", currentTime.Format("20060102_150405")))
+
+	config.MatchingMode = getEnv("MATCHING_MODE", "")
+	if config.MatchingMode != "" && config.MatchingMode != "fifo" && config.MatchingMode != "zero-crossing" {
+		return nil, fmt.Errorf("invalid MATCHING_MODE %q (use fifo, zero-crossing or leave empty)", config.MatchingMode)
+	}
+
+	config.DetailRecalcRules, err = ParseRecalcRules(getEnv("DETAIL_RECALC_RULES", ""))
+	if err != nil {
+		return nil, err
+	}
+	config.HeaderRecalcRules, err = ParseRecalcRules(getEnv("HEADER_RECALC_RULES", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	config.SoftDelete = getEnv("SOFT_DELETE", "false") == "true"
+	config.SoftDeleteColumn = getEnv("SOFT_DELETE_COLUMN", "deleted_at")
+	config.SoftDeleteFlagColumn = getEnv("SOFT_DELETE_FLAG_COLUMN", "")
+	config.SoftDeleteRunColumn = getEnv("SOFT_DELETE_RUN_COLUMN", "deleted_run")
+	for _, column := range []string{config.SoftDeleteColumn, config.SoftDeleteFlagColumn, config.SoftDeleteRunColumn} {
+		if column != "" && (!identifierPattern.MatchString(column) || strings.Contains(column, ".")) {
+			return nil, fmt.Errorf("invalid soft delete column name %q", column)
+		}
+	}
+	if config.SoftDeleteColumn == "" {
+		return nil, fmt.Errorf("SOFT_DELETE_COLUMN must not be empty")
+	}
+	config.PurgeAfterDays, err = getEnvInt("PURGE_AFTER_DAYS", 90)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ArchiveTarget = getEnv("ARCHIVE_TARGET", "none")
+	config.ArchiveDBHost = getEnv("ARCHIVE_DB_HOST", config.DBHost)
+	config.ArchiveDBPort = getEnv("ARCHIVE_DB_PORT", config.DBPort)
+	config.ArchiveDBUser = getEnv("ARCHIVE_DB_USER", config.DBUser)
+	config.ArchiveDBPassword = getEnv("ARCHIVE_DB_PASSWORD", config.DBPassword)
+	config.ArchiveDBName = getEnv("ARCHIVE_DB_NAME", "")
+	config.ArchiveDir = getEnv("ARCHIVE_DIR", "archive")
+	config.ArchiveFormat = getEnv("ARCHIVE_FORMAT", "jsonl")
+	if config.ArchiveFormat != "jsonl" && config.ArchiveFormat != "csv" {
+		return nil, fmt.Errorf("invalid ARCHIVE_FORMAT %q (use jsonl or csv)", config.ArchiveFormat)
+	}
+	config.ArchiveKey = getEnv("ARCHIVE_KEY", "")
+	config.ArchiveKeyFile = getEnv("ARCHIVE_KEY_FILE", "")
+	config.S3Endpoint = getEnv("S3_ENDPOINT", "")
+	config.S3Region = getEnv("S3_REGION", "us-east-1")
+	config.S3Bucket = getEnv("S3_BUCKET", "")
+	config.S3Prefix = getEnv("S3_PREFIX", "")
+	config.S3AccessKey = getEnv("S3_ACCESS_KEY", "")
+	config.S3SecretKey = getEnv("S3_SECRET_KEY", "")
+	config.S3PartSizeMB, err = getEnvInt("S3_PART_SIZE_MB", 16)
+	if err != nil {
+		return nil, err
+	}
+	switch config.ArchiveTarget {
+	case "none", "schema", "file":
+	case "s3":
+		if config.S3Endpoint == "" || config.S3Bucket == "" || config.S3AccessKey == "" || config.S3SecretKey == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for ARCHIVE_TARGET=s3")
+		}
+		if config.S3PartSizeMB < 5 {
+			return nil, fmt.Errorf("S3_PART_SIZE_MB must be at least 5")
+		}
+	case "database":
+		if config.ArchiveDBName == "" {
+			return nil, fmt.Errorf("ARCHIVE_DB_NAME is required for ARCHIVE_TARGET=database")
+		}
+	default:
+		return nil, fmt.Errorf("invalid ARCHIVE_TARGET %q (use none, schema, database, file or s3)", config.ArchiveTarget)
+	}
+
+	for env, lookup := range map[string]**NameLookup{
+		"ITEM_LOOKUP":     &config.ItemLookup,
+		"LOCATION_LOOKUP": &config.LocationLookup,
+		"SHOP_LOOKUP":     &config.ShopLookup,
+		"PARTNER_LOOKUP":  &config.PartnerLookup,
+	} {
+		*lookup, err = ParseNameLookup(getEnv(env, ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", env, err)
+		}
 	}
 
 	// Validate required configuration
@@ -56,6 +237,12 @@ func (c *Config) GetDSN() string {
 		c.DBUser, c.DBPassword, c.DBHost, c.DBPort, c.DBName)
 }
 
+// GetArchiveDSN returns the archive database connection string
+func (c *Config) GetArchiveDSN() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		c.ArchiveDBUser, c.ArchiveDBPassword, c.ArchiveDBHost, c.ArchiveDBPort, c.ArchiveDBName)
+}
+
 // loadEnv loads environment variables from a file
 func loadEnv(filename string) error {
 	file, err := os.Open(filename)
@@ -101,3 +288,16 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// getEnvInt gets an integer environment variable with fallback
+func getEnvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %q is not a number", key, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var relativeCutoffPattern = regexp.MustCompile(`^-(\d+)([dwmy])$`)
+var fiscalYearEndPattern = regexp.MustCompile(`^fiscal-year-end(?:-(\d+))?$`)
+
+// ResolveCutoffDate turns the CUTOFF_DATE expression into a concrete date.
+// Supported forms are a literal YYYY-MM-DD date, relative offsets such as
+// -30d, -6w, -18m or -2y, start-of-month, start-of-year, fiscal-year-end-N
+// and last-closed-period (read from the period-lock table).
+// A cutoff after today is rejected.
+func (cs *CleanupService) ResolveCutoffDate(config *Config, now time.Time) (time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	cutoff, err := cs.resolveCutoffExpression(config, today)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if cutoff.After(today) {
+		return time.Time{}, fmt.Errorf("cutoff date %q resolves to %s, which is after today", config.CutoffDate, cutoff.Format("2006-01-02"))
+	}
+	return cutoff, nil
+}
+
+func (cs *CleanupService) resolveCutoffExpression(config *Config, today time.Time) (time.Time, error) {
+	expr := strings.ToLower(strings.TrimSpace(config.CutoffDate))
+
+	if date, err := time.Parse("2006-01-02", expr); err == nil {
+		return date, nil
+	}
+
+	if m := relativeCutoffPattern.FindStringSubmatch(expr); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "d":
+			return today.AddDate(0, 0, -n), nil
+		case "w":
+			return today.AddDate(0, 0, -7*n), nil
+		case "m":
+			return monthsBack(today, n), nil
+		default:
+			return monthsBack(today, 12*n), nil
+		}
+	}
+
+	if m := fiscalYearEndPattern.FindStringSubmatch(expr); m != nil {
+		yearsBack := 1
+		if m[1] != "" {
+			yearsBack, _ = strconv.Atoi(m[1])
+		}
+		return fiscalYearEnd(today, config.FiscalYearStartMonth, yearsBack), nil
+	}
+
+	switch expr {
+	case "start-of-month":
+		return time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	case "start-of-year":
+		return time.Date(today.Year(), time.January, 1, 0, 0, 0, 0, time.UTC), nil
+	case "last-closed-period":
+		return cs.FindLastClosedPeriod(config.PeriodLockTable, config.PeriodLockColumn)
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported cutoff date %q (use YYYY-MM-DD, -Nd/-Nw/-Nm/-Ny, start-of-month, start-of-year, fiscal-year-end-N or last-closed-period)", config.CutoffDate)
+}
+
+// monthsBack returns the same day n months before today, or the last day of that
+// month when it is shorter, so Aug 31 - 6m is the end of February
+func monthsBack(today time.Time, n int) time.Time {
+	first := time.Date(today.Year(), today.Month()-time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(today.Day(), lastDay)-1)
+}
+
+// fiscalYearEnd returns the last day of the fiscal year yearsBack years
+// before the one containing today. yearsBack = 0 is the current fiscal year,
+// plain fiscal-year-end means 1, the last closed one.
+func fiscalYearEnd(today time.Time, startMonth int, yearsBack int) time.Time {
+	start := time.Date(today.Year(), time.Month(startMonth), 1, 0, 0, 0, 0, time.UTC)
+	if start.After(today) {
+		start = start.AddDate(-1, 0, 0)
+	}
+	return start.AddDate(1-yearsBack, 0, -1)
+}
+
+// FindLastClosedPeriod reads the most recent closed period date from the period-lock table
+func (cs *CleanupService) FindLastClosedPeriod(table, column string) (time.Time, error) {
+	tableName, err := quoteIdentifier(table)
+	if err != nil {
+		return time.Time{}, err
+	}
+	columnName, err := quoteIdentifier(column)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var closedUntil sql.NullTime
+	query := fmt.Sprintf("SELECT MAX(%s) FROM %s", columnName, tableName)
+	if err := cs.conn().QueryRow(query).Scan(&closedUntil); err != nil {
+		return time.Time{}, fmt.Errorf("error reading last closed period from %s.%s: %v", table, column, err)
+	}
+
+	if !closedUntil.Valid {
+		return time.Time{}, fmt.Errorf("no closed period found in %s.%s", table, column)
+	}
+
+	t := closedUntil.Time
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveCutoffDate(t *testing.T) {
+	now := time.Date(2025, time.March, 15, 10, 30, 0, 0, time.UTC)
+	cs := &CleanupService{}
+
+	for _, tt := range []struct {
+		expr       string
+		fiscalYear int
+		want       string
+	}{
+		{"2024-12-31", 1, "2024-12-31"},
+		{"-30d", 1, "2025-02-13"},
+		{"-6w", 1, "2025-02-01"},
+		{"-18m", 1, "2023-09-15"},
+		{"-2y", 1, "2023-03-15"},
+		{" Start-Of-Month ", 1, "2025-03-01"},
+		{"start-of-year", 1, "2025-01-01"},
+		{"fiscal-year-end", 1, "2024-12-31"},
+		{"fiscal-year-end-1", 1, "2024-12-31"},
+		{"fiscal-year-end", 7, "2024-06-30"},
+		{"fiscal-year-end", 4, "2024-03-31"},
+		{"fiscal-year-end", 3, "2025-02-28"},
+		{"fiscal-year-end-2", 4, "2023-03-31"},
+	} {
+		config := &Config{CutoffDate: tt.expr, FiscalYearStartMonth: tt.fiscalYear}
+		got, err := cs.ResolveCutoffDate(config, now)
+		if err != nil {
+			t.Errorf("ResolveCutoffDate(%q, fiscal month %d): %v", tt.expr, tt.fiscalYear, err)
+			continue
+		}
+		if got.Format("2006-01-02") != tt.want {
+			t.Errorf("ResolveCutoffDate(%q, fiscal month %d) = %s, want %s",
+				tt.expr, tt.fiscalYear, got.Format("2006-01-02"), tt.want)
+		}
+	}
+}
+
+func TestResolveCutoffDateRejectsUnknownExpressions(t *testing.T) {
+	cs := &CleanupService{}
+	for _, expr := range []string{"", "yesterday", "-5x", "30d", "2024-13-01", "fiscal-year-end-x"} {
+		_, err := cs.ResolveCutoffDate(&Config{CutoffDate: expr, FiscalYearStartMonth: 1}, time.Now())
+		if err == nil || !strings.Contains(err.Error(), "unsupported cutoff date") {
+			t.Errorf("ResolveCutoffDate(%q) error = %v, want unsupported cutoff date", expr, err)
+		}
+	}
+}
+
+func TestResolveCutoffDateClampsToMonthEnd(t *testing.T) {
+	cs := &CleanupService{}
+	for _, tt := range []struct {
+		now  time.Time
+		expr string
+		want string
+	}{
+		{time.Date(2025, time.August, 31, 0, 0, 0, 0, time.UTC), "-6m", "2025-02-28"},
+		{time.Date(2024, time.August, 31, 0, 0, 0, 0, time.UTC), "-6m", "2024-02-29"},
+		{time.Date(2025, time.March, 31, 0, 0, 0, 0, time.UTC), "-1m", "2025-02-28"},
+		{time.Date(2025, time.May, 31, 0, 0, 0, 0, time.UTC), "-13m", "2024-04-30"},
+		{time.Date(2025, time.January, 31, 0, 0, 0, 0, time.UTC), "-2m", "2024-11-30"},
+		{time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC), "-1y", "2023-02-28"},
+		{time.Date(2025, time.July, 15, 0, 0, 0, 0, time.UTC), "-6m", "2025-01-15"},
+	} {
+		got, err := cs.ResolveCutoffDate(&Config{CutoffDate: tt.expr, FiscalYearStartMonth: 1}, tt.now)
+		if err != nil {
+			t.Errorf("ResolveCutoffDate(%q) on %s: %v", tt.expr, tt.now.Format("2006-01-02"), err)
+			continue
+		}
+		if got.Format("2006-01-02") != tt.want {
+			t.Errorf("ResolveCutoffDate(%q) on %s = %s, want %s", tt.expr, tt.now.Format("2006-01-02"), got.Format("2006-01-02"), tt.want)
+		}
+	}
+}
+
+func TestResolveCutoffDateRejectsFutureDates(t *testing.T) {
+	now := time.Date(2025, time.March, 15, 10, 30, 0, 0, time.UTC)
+	cs := &CleanupService{}
+	for _, expr := range []string{"fiscal-year-end-0", "2025-03-16"} {
+		_, err := cs.ResolveCutoffDate(&Config{CutoffDate: expr, FiscalYearStartMonth: 1}, now)
+		if err == nil || !strings.Contains(err.Error(), "after today") {
+			t.Errorf("ResolveCutoffDate(%q) error = %v, want after today", expr, err)
+		}
+	}
+	if _, err := cs.ResolveCutoffDate(&Config{CutoffDate: "2025-03-15", FiscalYearStartMonth: 1}, now); err != nil {
+		t.Errorf("ResolveCutoffDate(today): %v", err)
+	}
+}
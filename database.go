@@ -6,9 +6,32 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// dbExecutor is implemented by both *sql.DB and *sql.Tx
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// dbTx is the transaction used by a cleanup step, implemented by *sql.Tx and *sqlSession
+type dbTx interface {
+	dbExecutor
+	Commit() error
+	Rollback() error
+}
+
 // ConnectDatabase establishes connection to the MySQL database
 func ConnectDatabase(config *Config) (*sql.DB, error) {
-	db, err := sql.Open("mysql", config.GetDSN())
+	return openDatabase(config.GetDSN())
+}
+
+// ConnectArchiveDatabase establishes connection to the archive database
+func ConnectArchiveDatabase(config *Config) (*sql.DB, error) {
+	return openDatabase(config.GetArchiveDSN())
+}
+
+func openDatabase(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlRecorder collects the statements executed in a session with their arguments inlined,
+// and for each one the statements restoring the rows it changes
+type sqlRecorder struct {
+	statements []string
+	undo       [][]string
+}
+
+// mutationPattern matches the UPDATE and DELETE statements of the cleanup steps, which all
+// select rows by id, either with an IN list or with the id as the last argument
+var mutationPattern = regexp.MustCompile(`(?is)^\s*(UPDATE|DELETE\s+FROM)\s+(\w+)\b.*\bWHERE\s+(?:\w+\.)?id\s*(?:IN\s*\(([\d,\s]+)\)|=\s*\?)`)
+
+// before reads the rows the statement is about to change and records how to restore them:
+// deleted rows are inserted again, updated rows get all their previous values back
+func (r *sqlRecorder) before(tx *sql.Tx, query string, args []any) error {
+	m := mutationPattern.FindStringSubmatch(query)
+	if m == nil {
+		return fmt.Errorf("cannot record undo for statement: %s", compactSQL(query))
+	}
+
+	table := m[2]
+	inClause := m[3]
+	if inClause == "" {
+		if len(args) == 0 {
+			return fmt.Errorf("cannot record undo for statement: %s", compactSQL(query))
+		}
+		inClause = sqlLiteral(args[len(args)-1])
+	}
+
+	columns, rows, err := selectRowsByIDs(tx, table, inClause)
+	if err != nil {
+		return err
+	}
+
+	deleting := strings.HasPrefix(strings.ToUpper(m[1]), "DELETE")
+	var undo []string
+	for _, row := range rows {
+		if deleting {
+			undo = append(undo, insertStatement(table, columns, row))
+		} else {
+			undo = append(undo, restoreStatement(table, columns, row))
+		}
+	}
+	r.undo = append(r.undo, undo)
+	return nil
+}
+
+// record adds an executed statement to the script
+func (r *sqlRecorder) record(query string, args []any, affected int64) {
+	r.statements = append(r.statements,
+		fmt.Sprintf("-- %d rows\n%s;", affected, inlineArgs(compactSQL(query), args)))
+}
+
+// EmitSQL writes the statements recorded in the open session to path, and the undo
+// statements in reverse order to undoPath, each wrapped in one transaction.
+// It returns the number of statements in the script and in the undo script.
+func (cs *CleanupService) EmitSQL(path, undoPath string) (int, int, error) {
+	if cs.session == nil || cs.session.recorder == nil {
+		return 0, 0, fmt.Errorf("no recording session is open")
+	}
+	recorder := cs.session.recorder
+
+	header := fmt.Sprintf("-- Cleanup run %s, generated %s", cs.config.RunID, time.Now().Format("2006-01-02 15:04:05"))
+	err := writeSQLScript(path, header, recorder.statements)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var undo []string
+	for i := len(recorder.undo) - 1; i >= 0; i-- {
+		undo = append(undo, recorder.undo[i]...)
+	}
+	err = writeSQLScript(undoPath, header+", undo of "+path, undo)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(recorder.statements), len(undo), nil
+}
+
+func writeSQLScript(path, header string, statements []string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, header)
+	fmt.Fprintln(w, "START TRANSACTION;")
+	for _, statement := range statements {
+		fmt.Fprintln(w, statement)
+	}
+	fmt.Fprintln(w, "COMMIT;")
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// insertStatement builds the INSERT recreating a deleted row
+func insertStatement(table string, columns []string, row []any) string {
+	values := make([]string, len(row))
+	for i, value := range row {
+		values[i] = sqlLiteral(value)
+	}
+	return fmt.Sprintf("INSERT INTO %s (`%s`) VALUES (%s);", table, strings.Join(columns, "`, `"), strings.Join(values, ", "))
+}
+
+// restoreStatement builds the UPDATE setting every column of a row back to its previous value
+func restoreStatement(table string, columns []string, row []any) string {
+	var assignments []string
+	id := ""
+	for i, column := range columns {
+		if column == "id" {
+			id = sqlLiteral(row[i])
+			continue
+		}
+		assignments = append(assignments, fmt.Sprintf("`%s` = %s", column, sqlLiteral(row[i])))
+	}
+	return fmt.Sprintf("UPDATE %s SET %s WHERE id = %s;", table, strings.Join(assignments, ", "), id)
+}
+
+// inlineArgs replaces the ? placeholders of a query with the arguments as SQL literals
+func inlineArgs(query string, args []any) string {
+	var sb strings.Builder
+	next := 0
+	for _, r := range query {
+		if r == '?' && next < len(args) {
+			sb.WriteString(sqlLiteral(args[next]))
+			next++
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// compactSQL collapses the whitespace of a multi-line query into single spaces
+func compactSQL(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+var sqlStringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// sqlLiteral formats a value as a MySQL literal
+func sqlLiteral(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return "'" + sqlStringEscaper.Replace(string(v)) + "'"
+	case string:
+		return "'" + sqlStringEscaper.Replace(v) + "'"
+	case time.Time:
+		return "'" + v.Format("2006-01-02 15:04:05.999999") + "'"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "'" + sqlStringEscaper.Replace(fmt.Sprint(v)) + "'"
+	}
+}
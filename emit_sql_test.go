@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSQLLiteral(t *testing.T) {
+	for _, tt := range []struct {
+		value any
+		want  string
+	}{
+		{nil, "NULL"},
+		{"plain", "'plain'"},
+		{"it's", `'it\'s'`},
+		{`back\slash`, `'back\\slash'`},
+		{"line\nbreak\r\x00\x1a", `'line\nbreak\r\0\Z'`},
+		{[]byte("2.500"), "'2.500'"},
+		{time.Date(2024, time.January, 31, 8, 5, 0, 0, time.UTC), "'2024-01-31 08:05:00'"},
+		{time.Date(2024, time.January, 31, 8, 5, 0, 250000000, time.UTC), "'2024-01-31 08:05:00.25'"},
+		{true, "1"},
+		{false, "0"},
+		{42, "42"},
+		{int64(-7), "-7"},
+		{2.5, "2.5"},
+		{float64(3), "3"},
+		{uint8(9), "'9'"},
+	} {
+		if got := sqlLiteral(tt.value); got != tt.want {
+			t.Errorf("sqlLiteral(%#v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestInsertStatement(t *testing.T) {
+	got := insertStatement("journal", []string{"id", "detailFk", "quantity", "comment"},
+		[]any{int64(7), nil, []byte("1.250"), "O'Brien"})
+	want := "INSERT INTO journal (`id`, `detailFk`, `quantity`, `comment`) VALUES (7, NULL, '1.250', 'O\\'Brien');"
+	if got != want {
+		t.Errorf("insertStatement =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRestoreStatement(t *testing.T) {
+	got := restoreStatement("form_detail", []string{"quantity", "id", "headerFk"}, []any{[]byte("4.000"), int64(12), int64(3)})
+	want := "UPDATE form_detail SET `quantity` = '4.000', `headerFk` = 3 WHERE id = 12;"
+	if got != want {
+		t.Errorf("restoreStatement =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInlineArgs(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		args  []any
+		want  string
+	}{
+		{"UPDATE journal SET quantity = ? WHERE id = ?", []any{1.5, 3}, "UPDATE journal SET quantity = 1.5 WHERE id = 3"},
+		{"DELETE FROM journal WHERE id IN (1,2)", nil, "DELETE FROM journal WHERE id IN (1,2)"},
+		{"SELECT ?, ?", []any{"a?b"}, "SELECT 'a?b', ?"},
+	} {
+		if got := inlineArgs(tt.query, tt.args); got != tt.want {
+			t.Errorf("inlineArgs(%q, %v) = %s, want %s", tt.query, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCompactSQL(t *testing.T) {
+	got := compactSQL("\n\t\tSELECT id\n\t\tFROM journal\n\t\tWHERE  id = ?\n\t")
+	if got != "SELECT id FROM journal WHERE id = ?" {
+		t.Errorf("compactSQL = %q", got)
+	}
+}
+
+func TestMutationPattern(t *testing.T) {
+	for _, tt := range []struct {
+		query    string
+		table    string
+		inClause string
+		match    bool
+	}{
+		{"DELETE FROM journal WHERE id IN (1,2,3)", "journal", "1,2,3", true},
+		{"UPDATE journal SET quantity = ? WHERE id = ?", "journal", "", true},
+		{"UPDATE form_detail SET `deletedAt` = NOW(), `deletedRun` = ? WHERE id IN (4, 5) AND `deletedAt` IS NULL", "form_detail", "4, 5", true},
+		{"\n\t\tUPDATE form_header fh SET fh.total = (SELECT SUM(fd.amount) FROM form_detail fd WHERE fd.headerFk = fh.id)\n\t\tWHERE fh.id IN (7)", "form_header", "7", true},
+		{"delete from form_header where id in (9)", "form_header", "9", true},
+		{"DELETE FROM journal WHERE detailFk IN (1,2)", "", "", false},
+		{"INSERT INTO journal (id) VALUES (1)", "", "", false},
+	} {
+		m := mutationPattern.FindStringSubmatch(tt.query)
+		if (m != nil) != tt.match {
+			t.Errorf("mutationPattern match of %q = %v, want %v", tt.query, m != nil, tt.match)
+			continue
+		}
+		if m != nil && (m[2] != tt.table || m[3] != tt.inClause) {
+			t.Errorf("mutationPattern of %q = table %q, ids %q, want %q, %q", tt.query, m[2], m[3], tt.table, tt.inClause)
+		}
+	}
+}
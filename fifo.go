@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FindNonZeroBalanceRecords returns the journal rows on or before the cutoff date
+// of every group whose balance at the cutoff is not zero
+func (cs *CleanupService) FindNonZeroBalanceRecords(cutoffDate time.Time) ([]DeletedRecord, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM journal j
+		INNER JOIN (
+			SELECT referenceFk, itemFk, locationFk, shopFk
+			FROM journal
+			WHERE accountFk = 2
+			  AND journalDate <= ?
+			  AND referenceFk IS NOT NULL
+			  AND %s
+			GROUP BY referenceFk, itemFk, locationFk, shopFk
+			HAVING SUM(type * quantity) <> 0
+		) g ON j.referenceFk = g.referenceFk
+		   AND j.itemFk = g.itemFk
+		   AND j.locationFk = g.locationFk
+		   AND j.shopFk = g.shopFk
+		INNER JOIN form_detail fd ON j.detailFk = fd.id
+		INNER JOIN form_header fh ON fd.headerFk = fh.id
+		WHERE j.accountFk = 2
+		  AND j.journalDate <= ?
+		  AND %s
+		  AND %s
+		  AND %s
+		ORDER BY j.referenceFk, j.itemFk, j.locationFk, j.shopFk, j.journalDate, j.id
+	`, deletedRecordColumns, cs.notDeleted(""), cs.notDeleted("j"), cs.notDeleted("fd"), cs.notDeleted("fh"))
+
+	cutoff := cutoffDate.Format("2006-01-02")
+	rows, err := cs.conn().Query(query, cutoff, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDeletedRecords(rows)
+}
+
+// fifoLot is a purchase row with the quantity not yet consumed by sales
+type fifoLot struct {
+	index     int
+	remaining float64
+}
+
+// fifoAllocation is the quantity of a sale row matched against a purchase lot
+type fifoAllocation struct {
+	sale     int
+	lot      int
+	quantity float64
+}
+
+// PlanFIFOMatching walks each group in journalDate order, matching sales against the
+// oldest purchases. Purchases fully consumed are deleted together with the sale quantity
+// matched against them; the open layer and the net balance of the group are unchanged.
+func PlanFIFOMatching(records []DeletedRecord) []JournalReduction {
+	groups := make(map[groupKey][]DeletedRecord)
+	var order []groupKey
+	for _, record := range records {
+		key := recordGroupKey(record)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], record)
+	}
+
+	var reductions []JournalReduction
+	for _, key := range order {
+		rows := groups[key]
+		sort.SliceStable(rows, func(i, j int) bool {
+			if rows[i].TxnDate != rows[j].TxnDate {
+				return rows[i].TxnDate < rows[j].TxnDate
+			}
+			return rows[i].JournalID < rows[j].JournalID
+		})
+
+		var lots []*fifoLot
+		var allocations []fifoAllocation
+		for i, row := range rows {
+			if row.Type > 0 {
+				lots = append(lots, &fifoLot{index: i, remaining: row.Quantity})
+				continue
+			}
+			need := row.Quantity
+			for _, lot := range lots {
+				if need <= 0.001 {
+					break
+				}
+				if lot.remaining <= 0.001 {
+					continue
+				}
+				take := need
+				if lot.remaining < take {
+					take = lot.remaining
+				}
+				lot.remaining -= take
+				need -= take
+				allocations = append(allocations, fifoAllocation{sale: i, lot: lot.index, quantity: take})
+			}
+		}
+
+		consumed := make(map[int]bool)
+		for _, lot := range lots {
+			if lot.remaining <= 0.001 {
+				consumed[lot.index] = true
+			}
+		}
+		if len(consumed) == 0 {
+			continue
+		}
+
+		saleRemoved := make(map[int]float64)
+		for _, allocation := range allocations {
+			if consumed[allocation.lot] {
+				saleRemoved[allocation.sale] += allocation.quantity
+			}
+		}
+
+		for i, row := range rows {
+			removed := 0.0
+			if consumed[i] {
+				removed = row.Quantity
+			} else {
+				removed = saleRemoved[i]
+			}
+			if removed <= 0.001 {
+				continue
+			}
+			newQty := row.Quantity - removed
+			reductions = append(reductions, JournalReduction{
+				Record:      row,
+				Removed:     removed,
+				NewQuantity: newQty,
+				Delete:      newQty <= 0.001,
+			})
+		}
+	}
+
+	return reductions
+}
+
+// PerformFIFOReduction deletes fully matched journal rows, reduces partially matched ones
+// and reduces the matched quantity from their form_detail in a single transaction
+func (cs *CleanupService) PerformFIFOReduction(reductions []JournalReduction) error {
+	if len(reductions) == 0 {
+		return nil
+	}
+
+	tx, err := cs.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	headerSeen := make(map[int]bool)
+	var journalIDs []int
+	var reducedIDs []int
+	var headerIDs []int
+	for _, reduction := range reductions {
+		if !headerSeen[reduction.Record.HeaderID] {
+			headerSeen[reduction.Record.HeaderID] = true
+			headerIDs = append(headerIDs, reduction.Record.HeaderID)
+		}
+		if reduction.Delete {
+			journalIDs = append(journalIDs, reduction.Record.JournalID)
+		} else {
+			reducedIDs = append(reducedIDs, reduction.Record.JournalID)
+		}
+	}
+
+	// Keep the previous quantities of the reduced rows, so restore can set them back
+	err = cs.archiveUpdates(tx, "journal", reducedIDs)
+	if err != nil {
+		cs.logger.Printf("Error archiving journal records: %v", err)
+		return err
+	}
+	for _, reduction := range reductions {
+		if reduction.Delete {
+			continue
+		}
+
+		_, err := tx.Exec("UPDATE journal SET quantity = ? WHERE id = ?", reduction.NewQuantity, reduction.Record.JournalID)
+		if err != nil {
+			cs.logger.Printf("Error reducing journal ID %d: %v", reduction.Record.JournalID, err)
+			return err
+		}
+		cs.logger.Printf("journal ID %d: quantity %.3f reduced by %.3f to %.3f",
+			reduction.Record.JournalID, reduction.Record.Quantity, reduction.Removed, reduction.NewQuantity)
+	}
+
+	fmt.Printf("Deleting %d fully matched journal records...\n", len(journalIDs))
+	cs.logger.Printf("Deleting %d fully matched journal records: %v", len(journalIDs), journalIDs)
+
+	err = cs.deleteByIDs(tx, "journal", journalIDs)
+	if err != nil {
+		cs.logger.Printf("Error deleting journal records: %v", err)
+		return err
+	}
+
+	reducedDetails, err := cs.reduceDetailQuantities(tx, fifoReductions(reductions))
+	if err != nil {
+		return err
+	}
+
+	err = cs.recalculateTotals(tx, reducedDetails, headerIDs)
+	if err != nil {
+		return err
+	}
+
+	err = cs.commit(tx)
+	if err != nil {
+		cs.logger.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// ShowFIFOReductions displays the journal rows FIFO matching would delete or reduce
+func ShowFIFOReductions(reductions []JournalReduction, names *NameLookups) {
+	itemWidth := names.Width("item", 8)
+
+	fmt.Println("\nFIFO matching - journal records that would be deleted or reduced:")
+	fmt.Printf("%-10s %-10s %-10s %-*s %-6s %-12s %-12s %-8s\n",
+		"JournalID", "DetailID", "RefFk", itemWidth, "Item", "Type", "Quantity", "NewQty", "Action")
+	fmt.Println(strings.Repeat("-", 76+itemWidth))
+
+	count := 0
+	for _, reduction := range reductions {
+		if count >= 20 {
+			fmt.Printf("... and %d more records\n", len(reductions)-20)
+			break
+		}
+		action := "reduce"
+		if reduction.Delete {
+			action = "delete"
+		}
+		fmt.Printf("%-10d %-10d %-10d %-*s %-6d %-12.3f %-12.3f %-8s\n",
+			reduction.Record.JournalID, reduction.Record.DetailID, reduction.Record.ReferenceFk,
+			itemWidth, names.Label("item", reduction.Record.ItemFk),
+			reduction.Record.Type, reduction.Record.Quantity, reduction.NewQuantity, action)
+		count++
+	}
+}
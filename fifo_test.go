@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fifoRecord builds a journal row of the group (referenceFk 1, itemFk 1, location, shopFk 1)
+func fifoRecord(journalID int, date string, txnType int, quantity float64, location int) DeletedRecord {
+	return DeletedRecord{
+		JournalID:   journalID,
+		DetailID:    journalID * 10,
+		HeaderID:    journalID * 100,
+		TxnDate:     date,
+		ReferenceFk: 1,
+		ItemFk:      1,
+		LocationFk:  location,
+		ShopFk:      1,
+		Type:        txnType,
+		Quantity:    quantity,
+	}
+}
+
+// fifoResult is the part of a JournalReduction the tests compare
+type fifoResult struct {
+	JournalID   int
+	Removed     float64
+	NewQuantity float64
+	Delete      bool
+}
+
+func TestPlanFIFOMatching(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		records []DeletedRecord
+		want    []fifoResult
+	}{
+		{
+			name: "consumed purchase and partially matched sale",
+			records: []DeletedRecord{
+				fifoRecord(1, "2024-01-01", 1, 10, 1),
+				fifoRecord(2, "2024-01-05", -1, 4, 1),
+				fifoRecord(3, "2024-01-10", -1, 8, 1),
+				fifoRecord(4, "2024-01-20", 1, 5, 1),
+			},
+			want: []fifoResult{
+				{1, 10, 0, true},
+				{2, 4, 0, true},
+				{3, 6, 2, false},
+			},
+		},
+		{
+			name: "no purchase fully consumed",
+			records: []DeletedRecord{
+				fifoRecord(1, "2024-01-01", 1, 10, 1),
+				fifoRecord(2, "2024-01-05", -1, 4, 1),
+			},
+		},
+		{
+			name: "sale before the purchase is not matched",
+			records: []DeletedRecord{
+				fifoRecord(1, "2024-01-01", -1, 3, 1),
+				fifoRecord(2, "2024-01-05", 1, 3, 1),
+			},
+		},
+		{
+			name: "rows sorted by date then id",
+			records: []DeletedRecord{
+				fifoRecord(5, "2024-02-01", -1, 5, 1),
+				fifoRecord(4, "2024-01-01", 1, 2, 1),
+				fifoRecord(3, "2024-01-01", 1, 3, 1),
+			},
+			want: []fifoResult{
+				{3, 3, 0, true},
+				{4, 2, 0, true},
+				{5, 5, 0, true},
+			},
+		},
+		{
+			name: "groups are matched separately",
+			records: []DeletedRecord{
+				fifoRecord(1, "2024-01-01", 1, 4, 1),
+				fifoRecord(2, "2024-01-02", 1, 4, 2),
+				fifoRecord(3, "2024-01-03", -1, 6, 2),
+				fifoRecord(4, "2024-01-04", -1, 1, 1),
+			},
+			want: []fifoResult{
+				{2, 4, 0, true},
+				{3, 4, 2, false},
+			},
+		},
+		{
+			name: "sale spanning two consumed lots",
+			records: []DeletedRecord{
+				fifoRecord(1, "2024-01-01", 1, 2, 1),
+				fifoRecord(2, "2024-01-02", 1, 3, 1),
+				fifoRecord(3, "2024-01-03", 1, 4, 1),
+				fifoRecord(4, "2024-01-04", -1, 6, 1),
+			},
+			want: []fifoResult{
+				{1, 2, 0, true},
+				{2, 3, 0, true},
+				{4, 5, 1, false},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []fifoResult
+			for _, reduction := range PlanFIFOMatching(tt.records) {
+				got = append(got, fifoResult{reduction.Record.JournalID, reduction.Removed, reduction.NewQuantity, reduction.Delete})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reductions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanFIFOMatchingKeepsNetBalance(t *testing.T) {
+	records := []DeletedRecord{
+		fifoRecord(1, "2024-01-01", 1, 10, 1),
+		fifoRecord(2, "2024-01-05", -1, 4, 1),
+		fifoRecord(3, "2024-01-10", -1, 8, 1),
+		fifoRecord(4, "2024-01-20", 1, 5, 1),
+		fifoRecord(5, "2024-01-25", -1, 1.5, 1),
+	}
+
+	var before, removed float64
+	for _, record := range records {
+		before += float64(record.Type) * record.Quantity
+	}
+	for _, reduction := range PlanFIFOMatching(records) {
+		removed += float64(reduction.Record.Type) * reduction.Removed
+	}
+	if removed > 0.001 || removed < -0.001 {
+		t.Errorf("reductions change the net balance %.3f by %.3f", before, -removed)
+	}
+}
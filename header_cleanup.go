@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// journalQuantity is the part of a journal row that counts towards its form_detail's quantity
+type journalQuantity struct {
+	DetailID   int
+	LocationFk int
+	Type       int
+	Quantity   float64
+}
+
+// detailJournalQuantities sums journal quantities per form_detail the way detailJournalQuantity
+// does in SQL: form_detail.quantity is unsigned, so every row counts with its plain quantity,
+// except that a location transfer (both signs at different locations) only counts its incoming side.
+// Every cleanup step reduces a detail by this sum over the journal quantity it removes.
+func detailJournalQuantities(rows []journalQuantity) map[int]float64 {
+	type detailSums struct {
+		locations        map[int]bool
+		minType, maxType int
+		all, incoming    float64
+	}
+	sums := make(map[int]*detailSums)
+	for _, row := range rows {
+		s, ok := sums[row.DetailID]
+		if !ok {
+			s = &detailSums{locations: make(map[int]bool), minType: row.Type, maxType: row.Type}
+			sums[row.DetailID] = s
+		}
+		s.locations[row.LocationFk] = true
+		s.minType = min(s.minType, row.Type)
+		s.maxType = max(s.maxType, row.Type)
+		s.all += row.Quantity
+		if row.Type > 0 {
+			s.incoming += row.Quantity
+		}
+	}
+
+	quantities := make(map[int]float64, len(sums))
+	for detailID, s := range sums {
+		if len(s.locations) > 1 && s.minType < 0 && s.maxType > 0 {
+			quantities[detailID] = s.incoming
+		} else {
+			quantities[detailID] = s.all
+		}
+	}
+	return quantities
+}
+
+// recordReductions returns the quantity each form_detail loses when the records are deleted
+func recordReductions(records []DeletedRecord) map[int]float64 {
+	rows := make([]journalQuantity, len(records))
+	for i, record := range records {
+		rows[i] = journalQuantity{record.DetailID, record.LocationFk, record.Type, record.Quantity}
+	}
+	return detailJournalQuantities(rows)
+}
+
+// fifoReductions returns the quantity each form_detail loses through the FIFO reductions
+func fifoReductions(reductions []JournalReduction) map[int]float64 {
+	rows := make([]journalQuantity, len(reductions))
+	for i, reduction := range reductions {
+		record := reduction.Record
+		rows[i] = journalQuantity{record.DetailID, record.LocationFk, record.Type, reduction.Removed}
+	}
+	return detailJournalQuantities(rows)
+}
+
+// PlanDetailReductions computes the new quantity of every form_detail touched by the
+// records to delete, using the same arithmetic as PerformDeletion
+func (cs *CleanupService) PlanDetailReductions(records []DeletedRecord) ([]DetailReduction, error) {
+	return planDetailReductions(cs.conn(), records)
+}
+
+func planDetailReductions(q dbExecutor, records []DeletedRecord) ([]DetailReduction, error) {
+	headerByDetail := make(map[int]int)
+	for _, record := range records {
+		headerByDetail[record.DetailID] = record.HeaderID
+	}
+	return planDetailQuantities(q, recordReductions(records), headerByDetail)
+}
+
+// PlanFIFODetailReductions computes the new quantity of every form_detail touched by the
+// FIFO reductions, using the same arithmetic as PerformFIFOReduction
+func (cs *CleanupService) PlanFIFODetailReductions(reductions []JournalReduction) ([]DetailReduction, error) {
+	headerByDetail := make(map[int]int)
+	for _, reduction := range reductions {
+		headerByDetail[reduction.Record.DetailID] = reduction.Record.HeaderID
+	}
+	return planDetailQuantities(cs.conn(), fifoReductions(reductions), headerByDetail)
+}
+
+// detailQuantity is the current quantity of a form_detail and the shop of its journal rows
+type detailQuantity struct {
+	Quantity float64
+	ShopFk   int
+}
+
+// planDetailQuantities reads the current quantity and the shop of each detail and subtracts reducedBy from it.
+// The shop comes from the detail's journal rows.
+func planDetailQuantities(q dbExecutor, reducedBy map[int]float64, headerByDetail map[int]int) ([]DetailReduction, error) {
+	var detailIDs []int
+	for detailID := range headerByDetail {
+		detailIDs = append(detailIDs, detailID)
+	}
+	sort.Ints(detailIDs)
+
+	current, err := readDetailQuantities(q, detailIDs)
+	if err != nil {
+		return nil, err
+	}
+	return applyDetailReductions(detailIDs, current, reducedBy, headerByDetail)
+}
+
+// readDetailQuantities reads the quantity and the shop of the given details in batches
+func readDetailQuantities(q dbExecutor, detailIDs []int) (map[int]detailQuantity, error) {
+	current := make(map[int]detailQuantity, len(detailIDs))
+
+	batchSize := 1000
+	for i := 0; i < len(detailIDs); i += batchSize {
+		end := i + batchSize
+		if end > len(detailIDs) {
+			end = len(detailIDs)
+		}
+		batch := detailIDs[i:end]
+
+		rows, err := q.Query(fmt.Sprintf(`
+			SELECT fd.id, fd.quantity, COALESCE(MIN(j.shopFk), 0)
+			FROM form_detail fd
+			LEFT JOIN journal j ON j.detailFk = fd.id
+			WHERE fd.id IN (%s)
+			GROUP BY fd.id, fd.quantity`, joinIDs(batch)))
+		if err != nil {
+			return nil, fmt.Errorf("error getting form_detail quantities: %v", err)
+		}
+		for rows.Next() {
+			var detailID int
+			var detail detailQuantity
+			if err := rows.Scan(&detailID, &detail.Quantity, &detail.ShopFk); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error getting form_detail quantities: %v", err)
+			}
+			current[detailID] = detail
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error getting form_detail quantities: %v", err)
+		}
+	}
+
+	return current, nil
+}
+
+// applyDetailReductions subtracts reducedBy from the current quantity of each detail
+func applyDetailReductions(detailIDs []int, current map[int]detailQuantity, reducedBy map[int]float64, headerByDetail map[int]int) ([]DetailReduction, error) {
+	var reductions []DetailReduction
+	for _, detailID := range detailIDs {
+		detail, ok := current[detailID]
+		if !ok {
+			return nil, fmt.Errorf("error getting form_detail quantity for ID %d: %v", detailID, sql.ErrNoRows)
+		}
+
+		newQty := detail.Quantity - reducedBy[detailID]
+		reductions = append(reductions, DetailReduction{
+			DetailID:    detailID,
+			HeaderID:    headerByDetail[detailID],
+			ShopFk:      detail.ShopFk,
+			OldQuantity: detail.Quantity,
+			ReducedBy:   reducedBy[detailID],
+			NewQuantity: newQty,
+			Delete:      newQty <= 0.001,
+		})
+	}
+
+	return reductions, nil
+}
+
+// PlanHeaderCleanup counts, per affected form_header, how many details would be
+// deleted, reduced or left untouched by the planned reductions
+func (cs *CleanupService) PlanHeaderCleanup(reductions []DetailReduction) ([]HeaderCleanup, error) {
+	return cs.planHeaderCleanup(cs.conn(), reductions)
+}
+
+func (cs *CleanupService) planHeaderCleanup(q dbExecutor, reductions []DetailReduction) ([]HeaderCleanup, error) {
+	if len(reductions) == 0 {
+		return nil, nil
+	}
+
+	headers := make(map[int]*HeaderCleanup)
+	var headerIDs []int
+	for _, reduction := range reductions {
+		header, ok := headers[reduction.HeaderID]
+		if !ok {
+			header = &HeaderCleanup{HeaderID: reduction.HeaderID}
+			headers[reduction.HeaderID] = header
+			headerIDs = append(headerIDs, reduction.HeaderID)
+		}
+		if reduction.Delete {
+			header.DeletedDetails++
+		} else {
+			header.ReducedDetails++
+		}
+	}
+	sort.Ints(headerIDs)
+
+	inClause := ""
+	for i, id := range headerIDs {
+		if i > 0 {
+			inClause += ","
+		}
+		inClause += fmt.Sprintf("%d", id)
+	}
+
+	rows, err := q.Query(fmt.Sprintf(`
+		SELECT headerFk, COUNT(*)
+		FROM form_detail
+		WHERE headerFk IN (%s)
+		  AND %s
+		GROUP BY headerFk
+	`, inClause, cs.notDeleted("")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var headerID, total int
+		if err := rows.Scan(&headerID, &total); err != nil {
+			return nil, err
+		}
+		header := headers[headerID]
+		header.TotalDetails = total
+		header.UntouchedDetails = total - header.DeletedDetails - header.ReducedDetails
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var result []HeaderCleanup
+	for _, id := range headerIDs {
+		result = append(result, *headers[id])
+	}
+	return result, nil
+}
+
+// deleteEmptiedHeaders deletes the given form_header rows that no longer have any form_detail
+func (cs *CleanupService) deleteEmptiedHeaders(tx dbExecutor, headerIDs []int) ([]int, error) {
+	if len(headerIDs) == 0 {
+		return nil, nil
+	}
+
+	inClause := ""
+	for i, id := range headerIDs {
+		if i > 0 {
+			inClause += ","
+		}
+		inClause += fmt.Sprintf("%d", id)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`
+		SELECT fh.id
+		FROM form_header fh
+		LEFT JOIN form_detail fd ON fh.id = fd.headerFk AND %s
+		WHERE fh.id IN (%s)
+		  AND fd.id IS NULL
+		  AND %s
+		ORDER BY fh.id
+	`, cs.notDeleted("fd"), inClause, cs.notDeleted("fh")))
+	if err != nil {
+		return nil, err
+	}
+
+	var emptied []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		emptied = append(emptied, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(emptied) > 0 {
+		fmt.Printf("Deleting %d form_header records whose details were all deleted...\n", len(emptied))
+		cs.logger.Printf("Deleting %d emptied form_header records: %v", len(emptied), emptied)
+
+		err = cs.deleteByIDs(tx, "form_header", emptied)
+		if err != nil {
+			cs.logger.Printf("Error deleting emptied form_header records: %v", err)
+			return nil, err
+		}
+	}
+
+	return emptied, nil
+}
+
+// ShowHeaderCleanup displays the headers that lose all details and the headers
+// left with a mix of cleaned and untouched details
+func ShowHeaderCleanup(headers []HeaderCleanup, dryRun bool) {
+	var emptied, partial []HeaderCleanup
+	for _, header := range headers {
+		if header.DeletedDetails == header.TotalDetails {
+			emptied = append(emptied, header)
+		} else if header.UntouchedDetails > 0 {
+			partial = append(partial, header)
+		}
+	}
+
+	verb := "were"
+	if dryRun {
+		verb = "would be"
+	}
+
+	if len(emptied) > 0 {
+		fmt.Printf("\n%d form_header records %s deleted because all their details are cleaned\n", len(emptied), verb)
+	}
+	if len(partial) == 0 {
+		return
+	}
+
+	fmt.Printf("\nform_header records left partially cleaned (%d):\n", len(partial))
+	fmt.Printf("%-10s %-8s %-8s %-8s %-10s\n", "HeaderID", "Total", "Deleted", "Reduced", "Untouched")
+	fmt.Println(strings.Repeat("-", 50))
+
+	count := 0
+	for _, header := range partial {
+		if count >= 20 {
+			fmt.Printf("... and %d more records\n", len(partial)-20)
+			break
+		}
+		fmt.Printf("%-10d %-8d %-8d %-8d %-10d\n",
+			header.HeaderID, header.TotalDetails, header.DeletedDetails, header.ReducedDetails, header.UntouchedDetails)
+		count++
+	}
+}
+
+// LogHeaderCleanup logs the headers that lose all details and the partially cleaned ones
+func LogHeaderCleanup(logger *log.Logger, headers []HeaderCleanup) {
+	for _, header := range headers {
+		if header.DeletedDetails == header.TotalDetails {
+			logger.Printf("form_header ID %d: all %d details cleaned, header deleted", header.HeaderID, header.TotalDetails)
+		} else if header.UntouchedDetails > 0 {
+			logger.Printf("form_header ID %d partially cleaned: %d deleted, %d reduced, %d untouched details",
+				header.HeaderID, header.DeletedDetails, header.ReducedDetails, header.UntouchedDetails)
+		}
+	}
+}
+
+// emptiedHeaderEntries derives compliance entries for headers deleted with their details
+// from the journal entries of the same header
+func emptiedHeaderEntries(headers []HeaderCleanup, entries []ComplianceEntry) []ComplianceEntry {
+	entryByHeader := make(map[int]ComplianceEntry)
+	for _, entry := range entries {
+		entryByHeader[entry.HeaderID] = entry
+	}
+
+	var result []ComplianceEntry
+	for _, header := range headers {
+		entry, ok := entryByHeader[header.HeaderID]
+		if !ok || header.DeletedDetails != header.TotalDetails {
+			continue
+		}
+		entry.Table = "form_header"
+		entry.ID = header.HeaderID
+		result = append(result, entry)
+	}
+	return result
+}
+
+// deletedDetailEntries derives compliance entries for the form_detail rows deleted because their
+// quantity reaches zero from the journal entries of the same detail
+func deletedDetailEntries(reductions []DetailReduction, records []DeletedRecord, entries []ComplianceEntry) []ComplianceEntry {
+	entryByJournal := make(map[int]ComplianceEntry)
+	for _, entry := range entries {
+		entryByJournal[entry.ID] = entry
+	}
+	entryByDetail := make(map[int]ComplianceEntry)
+	for _, record := range records {
+		if entry, ok := entryByJournal[record.JournalID]; ok {
+			entryByDetail[record.DetailID] = entry
+		}
+	}
+
+	var result []ComplianceEntry
+	for _, reduction := range reductions {
+		entry, ok := entryByDetail[reduction.DetailID]
+		if !ok || !reduction.Delete {
+			continue
+		}
+		entry.Table = "form_detail"
+		entry.ID = reduction.DetailID
+		result = append(result, entry)
+	}
+	return result
+}
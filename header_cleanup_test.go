@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetailJournalQuantities(t *testing.T) {
+	got := detailJournalQuantities([]journalQuantity{
+		{DetailID: 1, LocationFk: 5, Type: -1, Quantity: 3},
+		{DetailID: 1, LocationFk: 5, Type: -1, Quantity: 2},
+		{DetailID: 2, LocationFk: 5, Type: 1, Quantity: 4},
+		// Transfer of 6 from location 5 to 6
+		{DetailID: 3, LocationFk: 5, Type: -1, Quantity: 6},
+		{DetailID: 3, LocationFk: 6, Type: 1, Quantity: 6},
+		// Return at the same location is not a transfer
+		{DetailID: 4, LocationFk: 5, Type: 1, Quantity: 1},
+		{DetailID: 4, LocationFk: 5, Type: -1, Quantity: 1},
+	})
+	want := map[int]float64{1: 5, 2: 4, 3: 6, 4: 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("detailJournalQuantities = %v, want %v", got, want)
+	}
+}
+
+// TestSaleDetailReducedAlikeByEveryPath removes the same sale journal row of a detail through the
+// zero-balance deletion and through FIFO matching; both must leave the same detail quantity
+func TestSaleDetailReducedAlikeByEveryPath(t *testing.T) {
+	// form_detail 10 sells 5: one journal row of 3 (removed) and one of 2 (kept)
+	removedSale := DeletedRecord{JournalID: 1, DetailID: 10, HeaderID: 100, LocationFk: 5, ShopFk: 1, Type: -1, Quantity: 3}
+	keptSale := journalQuantity{DetailID: 10, LocationFk: 5, Type: -1, Quantity: 2}
+	detailQuantity := 5.0
+
+	deletion := recordReductions([]DeletedRecord{removedSale})
+	fifo := fifoReductions([]JournalReduction{{Record: removedSale, Removed: 3, Delete: true}})
+	orphan := detailJournalQuantities([]journalQuantity{{removedSale.DetailID, removedSale.LocationFk, removedSale.Type, removedSale.Quantity}})
+
+	for name, reducedBy := range map[string]map[int]float64{"deletion": deletion, "fifo": fifo, "orphaned journal": orphan} {
+		if got := detailQuantity - reducedBy[10]; got != 2 {
+			t.Errorf("%s path leaves form_detail 10 at %.3f, want 2", name, got)
+		}
+	}
+
+	if remaining := detailJournalQuantities([]journalQuantity{keptSale})[10]; remaining != detailQuantity-deletion[10] {
+		t.Errorf("reduced quantity %.3f differs from the journal quantity %.3f of the kept rows", detailQuantity-deletion[10], remaining)
+	}
+}
+
+func TestFIFOPartialReductionOfSaleDetail(t *testing.T) {
+	sale := DeletedRecord{JournalID: 3, DetailID: 30, HeaderID: 300, LocationFk: 5, ShopFk: 1, Type: -1, Quantity: 8}
+	got := fifoReductions([]JournalReduction{{Record: sale, Removed: 6, NewQuantity: 2}})
+	if got[30] != 6 {
+		t.Errorf("FIFO reduces the sale detail by %.3f, want the removed 6", got[30])
+	}
+}
+
+func TestApplyDetailReductions(t *testing.T) {
+	current := map[int]detailQuantity{10: {Quantity: 5, ShopFk: 1}, 11: {Quantity: 3, ShopFk: 2}}
+	got, err := applyDetailReductions([]int{10, 11}, current, map[int]float64{10: 3, 11: 3}, map[int]int{10: 100, 11: 101})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DetailReduction{
+		{DetailID: 10, HeaderID: 100, ShopFk: 1, OldQuantity: 5, ReducedBy: 3, NewQuantity: 2},
+		{DetailID: 11, HeaderID: 101, ShopFk: 2, OldQuantity: 3, ReducedBy: 3, NewQuantity: 0, Delete: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("applyDetailReductions = %+v, want %+v", got, want)
+	}
+
+	if _, err := applyDetailReductions([]int{12}, current, nil, map[int]int{12: 102}); err == nil {
+		t.Error("applyDetailReductions of a missing detail succeeded")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LegalHolds indexes legal hold entries for fast lookup
+type LegalHolds struct {
+	headers  map[int]LegalHold
+	partners map[int]LegalHold
+	items    map[int]LegalHold
+	ranges   []LegalHold
+}
+
+// Count returns the number of loaded hold entries
+func (h *LegalHolds) Count() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.headers) + len(h.partners) + len(h.items) + len(h.ranges)
+}
+
+func (h *LegalHolds) add(hold LegalHold) error {
+	switch hold.HoldType {
+	case "header":
+		h.headers[hold.RefID] = hold
+	case "partner":
+		h.partners[hold.RefID] = hold
+	case "item":
+		h.items[hold.RefID] = hold
+	case "dates":
+		if hold.DateFrom == "" || hold.DateTo == "" {
+			return fmt.Errorf("legal hold date range needs both dateFrom and dateTo")
+		}
+		hold.DateFrom = dateOnly(hold.DateFrom)
+		hold.DateTo = dateOnly(hold.DateTo)
+		h.ranges = append(h.ranges, hold)
+	default:
+		return fmt.Errorf("unknown legal hold type %q (use header, partner, item or dates)", hold.HoldType)
+	}
+	return nil
+}
+
+// Match returns the reason a record is held, if any. Zero IDs and empty dates are not matched.
+func (h *LegalHolds) Match(headerID, partnerFk, itemFk int, date string) (string, bool) {
+	if h.Count() == 0 {
+		return "", false
+	}
+	if hold, ok := h.headers[headerID]; ok && headerID != 0 {
+		return holdReason(fmt.Sprintf("header %d", headerID), hold), true
+	}
+	if hold, ok := h.partners[partnerFk]; ok && partnerFk != 0 {
+		return holdReason(fmt.Sprintf("partner %d", partnerFk), hold), true
+	}
+	if hold, ok := h.items[itemFk]; ok && itemFk != 0 {
+		return holdReason(fmt.Sprintf("item %d", itemFk), hold), true
+	}
+	if date != "" {
+		day := dateOnly(date)
+		for _, hold := range h.ranges {
+			if day >= hold.DateFrom && day <= hold.DateTo {
+				return holdReason(fmt.Sprintf("dates %s..%s", hold.DateFrom, hold.DateTo), hold), true
+			}
+		}
+	}
+	return "", false
+}
+
+// MatchItems is Match for a record with several items, like a header and the items of its details
+func (h *LegalHolds) MatchItems(headerID, partnerFk int, itemFks []int, date string) (string, bool) {
+	if reason, held := h.Match(headerID, partnerFk, 0, date); held {
+		return reason, true
+	}
+	for _, itemFk := range itemFks {
+		if reason, held := h.Match(0, 0, itemFk, ""); held {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+func holdReason(target string, hold LegalHold) string {
+	if hold.Reason == "" {
+		return "legal hold on " + target
+	}
+	return fmt.Sprintf("legal hold on %s: %s", target, hold.Reason)
+}
+
+// dateOnly trims a date or datetime string to YYYY-MM-DD
+func dateOnly(value string) string {
+	if len(value) >= 10 {
+		return value[:10]
+	}
+	return value
+}
+
+// LoadLegalHolds loads hold entries from the legal hold table and/or CSV file.
+// Either source may be empty to disable it.
+func (cs *CleanupService) LoadLegalHolds(table, file string) (*LegalHolds, error) {
+	holds := &LegalHolds{
+		headers:  make(map[int]LegalHold),
+		partners: make(map[int]LegalHold),
+		items:    make(map[int]LegalHold),
+	}
+
+	if table != "" {
+		tableName, err := quoteIdentifier(table)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := cs.conn().Query(fmt.Sprintf(`
+			SELECT 
+				holdType,
+				COALESCE(refId, 0),
+				COALESCE(dateFrom, ''),
+				COALESCE(dateTo, ''),
+				COALESCE(reason, '')
+			FROM %s
+		`, tableName))
+		if err != nil {
+			return nil, fmt.Errorf("error reading legal hold table %s: %v", table, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hold LegalHold
+			if err := rows.Scan(&hold.HoldType, &hold.RefID, &hold.DateFrom, &hold.DateTo, &hold.Reason); err != nil {
+				return nil, err
+			}
+			hold.HoldType = strings.ToLower(hold.HoldType)
+			if err := holds.add(hold); err != nil {
+				return nil, err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if file != "" {
+		if err := loadLegalHoldFile(file, holds); err != nil {
+			return nil, fmt.Errorf("error reading legal hold file %s: %v", file, err)
+		}
+	}
+
+	return holds, nil
+}
+
+// loadLegalHoldFile reads a CSV file with columns: type,id,date_from,date_to,reason
+func loadLegalHoldFile(filename string, holds *LegalHolds) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	line := 0
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		line++
+
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+		holdType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if line == 1 && holdType == "type" {
+			continue // header row
+		}
+
+		hold := LegalHold{
+			HoldType: holdType,
+			DateFrom: strings.TrimSpace(fields[2]),
+			DateTo:   strings.TrimSpace(fields[3]),
+			Reason:   strings.TrimSpace(fields[4]),
+		}
+		if id := strings.TrimSpace(fields[1]); id != "" {
+			hold.RefID, err = strconv.Atoi(id)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid id %q", line, id)
+			}
+		}
+		if err := holds.add(hold); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+
+	return nil
+}
+
+// ExcludeHeldRecords removes every balance group that contains a held journal row,
+// so the remaining deletions still net to zero per group
+func (cs *CleanupService) ExcludeHeldRecords(records []DeletedRecord, holds *LegalHolds, step string) ([]DeletedRecord, []SkippedRecord) {
+	if holds.Count() == 0 {
+		return records, nil
+	}
+
+	heldGroups := make(map[groupKey]string)
+	for _, record := range records {
+		key := recordGroupKey(record)
+		if _, done := heldGroups[key]; done {
+			continue
+		}
+		if reason, held := holds.Match(record.HeaderID, record.PartnerFk, record.ItemFk, record.TxnDate); held {
+			heldGroups[key] = fmt.Sprintf("%s (journal %d in same balance group)", reason, record.JournalID)
+		}
+	}
+
+	var kept []DeletedRecord
+	var skipped []SkippedRecord
+	for _, record := range records {
+		if reason, held := heldGroups[recordGroupKey(record)]; held {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "journal", ID: record.JournalID, Reason: reason})
+			continue
+		}
+		kept = append(kept, record)
+	}
+
+	return kept, skipped
+}
+
+// ExcludeHeldHeaders removes held form_header records from the orphaned headers,
+// including headers whose former details were for a held item
+func (cs *CleanupService) ExcludeHeldHeaders(headers []OrphanedHeader, holds *LegalHolds, step string) ([]OrphanedHeader, []SkippedRecord) {
+	if holds.Count() == 0 {
+		return headers, nil
+	}
+
+	var kept []OrphanedHeader
+	var skipped []SkippedRecord
+	for _, header := range headers {
+		if reason, held := holds.MatchItems(header.ID, header.PartnerFk, header.ItemFks, header.FormDate); held {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "form_header", ID: header.ID, Reason: reason})
+			continue
+		}
+		kept = append(kept, header)
+	}
+
+	return kept, skipped
+}
+
+// ExcludeHeldDetails removes form_detail records belonging to held headers, partners, items or dates
+func (cs *CleanupService) ExcludeHeldDetails(details []ZeroQuantityDetail, holds *LegalHolds, step string) ([]ZeroQuantityDetail, []SkippedRecord) {
+	if holds.Count() == 0 {
+		return details, nil
+	}
+
+	var kept []ZeroQuantityDetail
+	var skipped []SkippedRecord
+	for _, detail := range details {
+		if reason, held := holds.Match(detail.HeaderID, detail.PartnerFk, detail.ItemFk, detail.FormDate); held {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "form_detail", ID: detail.ID, Reason: reason})
+			continue
+		}
+		kept = append(kept, detail)
+	}
+
+	return kept, skipped
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testLegalHolds(t *testing.T, holds ...LegalHold) *LegalHolds {
+	h := &LegalHolds{
+		headers:  make(map[int]LegalHold),
+		partners: make(map[int]LegalHold),
+		items:    make(map[int]LegalHold),
+	}
+	for _, hold := range holds {
+		if err := h.add(hold); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+func TestLegalHoldsMatch(t *testing.T) {
+	holds := testLegalHolds(t,
+		LegalHold{HoldType: "header", RefID: 10, Reason: "tax audit"},
+		LegalHold{HoldType: "partner", RefID: 20},
+		LegalHold{HoldType: "item", RefID: 30, Reason: "recall"},
+		LegalHold{HoldType: "dates", DateFrom: "2023-01-01 00:00:00", DateTo: "2023-03-31", Reason: "dispute"},
+	)
+	if holds.Count() != 4 {
+		t.Errorf("Count = %d, want 4", holds.Count())
+	}
+
+	for _, tt := range []struct {
+		name                  string
+		header, partner, item int
+		date                  string
+		want                  string
+	}{
+		{"header", 10, 0, 0, "", "legal hold on header 10: tax audit"},
+		{"partner without reason", 1, 20, 0, "", "legal hold on partner 20"},
+		{"item", 1, 2, 30, "2024-01-01", "legal hold on item 30: recall"},
+		{"header wins over item", 10, 0, 30, "", "legal hold on header 10: tax audit"},
+		{"first day of range", 1, 2, 3, "2023-01-01", "legal hold on dates 2023-01-01..2023-03-31: dispute"},
+		{"last day of range with time", 1, 2, 3, "2023-03-31 23:59:59", "legal hold on dates 2023-01-01..2023-03-31: dispute"},
+		{"after the range", 1, 2, 3, "2023-04-01", ""},
+		{"no hold", 11, 21, 31, "2024-06-01", ""},
+		{"zero ids are not matched", 0, 0, 0, "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, held := holds.Match(tt.header, tt.partner, tt.item, tt.date)
+			if got != tt.want || held != (tt.want != "") {
+				t.Errorf("Match = %q, %v, want %q", got, held, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegalHoldsMatchZeroRefID(t *testing.T) {
+	holds := testLegalHolds(t, LegalHold{HoldType: "partner", RefID: 0})
+	if reason, held := holds.Match(0, 0, 0, ""); held {
+		t.Errorf("hold on partner 0 matched a record without partner: %s", reason)
+	}
+
+	var none *LegalHolds
+	if _, held := none.Match(1, 2, 3, "2024-01-01"); held {
+		t.Error("nil holds matched")
+	}
+}
+
+func TestLegalHoldsAddErrors(t *testing.T) {
+	holds := testLegalHolds(t)
+	for _, tt := range []struct {
+		hold    LegalHold
+		wantErr string
+	}{
+		{LegalHold{HoldType: "dates", DateFrom: "2023-01-01"}, "needs both dateFrom and dateTo"},
+		{LegalHold{HoldType: "customer", RefID: 1}, "unknown legal hold type"},
+	} {
+		err := holds.add(tt.hold)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("add(%+v) error = %v, want %q", tt.hold, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExcludeHeldHeadersAndDetailsByItem(t *testing.T) {
+	holds := testLegalHolds(t, LegalHold{HoldType: "item", RefID: 30, Reason: "recall"})
+	cs := &CleanupService{}
+
+	headers, skipped := cs.ExcludeHeldHeaders([]OrphanedHeader{
+		{ID: 1, ItemFks: []int{29, 30}},
+		{ID: 2, ItemFks: []int{31}},
+		{ID: 3},
+	}, holds, "orphaned")
+	if len(headers) != 2 || headers[0].ID != 2 || headers[1].ID != 3 {
+		t.Errorf("kept headers %+v, want 2 and 3", headers)
+	}
+	if len(skipped) != 1 || skipped[0].ID != 1 || skipped[0].Reason != "legal hold on item 30: recall" {
+		t.Errorf("skipped headers %+v, want 1 held for item 30", skipped)
+	}
+
+	details, skipped := cs.ExcludeHeldDetails([]ZeroQuantityDetail{{ID: 5, ItemFk: 30}, {ID: 6, ItemFk: 31}}, holds, "zero-qty")
+	if len(details) != 1 || details[0].ID != 6 {
+		t.Errorf("kept details %+v, want 6", details)
+	}
+	if len(skipped) != 1 || skipped[0].Table != "form_detail" || skipped[0].ID != 5 {
+		t.Errorf("skipped details %+v, want 5", skipped)
+	}
+}
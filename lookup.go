@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// nameColumns maps the foreign key columns of the listings to their lookup kind
+var nameColumns = map[string]string{
+	"ItemFk":     "item",
+	"LocationFk": "location",
+	"ShopFk":     "shop",
+	"PartnerFk":  "partner",
+}
+
+// NameLookup is the table holding the display names of one kind of foreign key
+type NameLookup struct {
+	Table      string
+	IDColumn   string
+	NameColumn string
+}
+
+// ParseNameLookup parses "table:name_column" or "table:id_column:name_column", e.g. "item:name".
+// The id column defaults to id. An empty spec disables the lookup.
+func ParseNameLookup(spec string) (*NameLookup, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(spec, ":")
+	lookup := &NameLookup{IDColumn: "id"}
+	switch len(parts) {
+	case 2:
+		lookup.Table, lookup.NameColumn = parts[0], parts[1]
+	case 3:
+		lookup.Table, lookup.IDColumn, lookup.NameColumn = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid lookup %q (use table:name_column or table:id_column:name_column)", spec)
+	}
+
+	if !identifierPattern.MatchString(lookup.Table) {
+		return nil, fmt.Errorf("invalid table %q in lookup %q", lookup.Table, spec)
+	}
+	for _, column := range []string{lookup.IDColumn, lookup.NameColumn} {
+		if !identifierPattern.MatchString(column) || strings.Contains(column, ".") {
+			return nil, fmt.Errorf("invalid column %q in lookup %q", column, spec)
+		}
+	}
+	return lookup, nil
+}
+
+// NameLookups resolves foreign keys to display names. Every id looked up is cached,
+// including ids without a row, so each one is queried at most once per run.
+type NameLookups struct {
+	db      *sql.DB
+	logger  *log.Logger
+	lookups map[string]*NameLookup
+	cache   map[string]map[int]string
+}
+
+func NewNameLookups(db *sql.DB, logger *log.Logger, config *Config) *NameLookups {
+	n := &NameLookups{
+		db:      db,
+		logger:  logger,
+		lookups: make(map[string]*NameLookup),
+		cache:   make(map[string]map[int]string),
+	}
+	for kind, lookup := range map[string]*NameLookup{
+		"item":     config.ItemLookup,
+		"location": config.LocationLookup,
+		"shop":     config.ShopLookup,
+		"partner":  config.PartnerLookup,
+	} {
+		if lookup != nil {
+			n.lookups[kind] = lookup
+			n.cache[kind] = make(map[int]string)
+		}
+	}
+	return n
+}
+
+// Enabled reports whether a lookup is configured for kind
+func (n *NameLookups) Enabled(kind string) bool {
+	return n != nil && n.lookups[kind] != nil
+}
+
+// Load fetches the names of all uncached ids of kind in batches
+func (n *NameLookups) Load(kind string, ids []int) error {
+	if !n.Enabled(kind) {
+		return nil
+	}
+	lookup := n.lookups[kind]
+	cache := n.cache[kind]
+
+	var missing []int
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if _, ok := cache[id]; !ok && !seen[id] {
+			missing = append(missing, id)
+			seen[id] = true
+		}
+	}
+
+	batchSize := 1000
+	for i := 0; i < len(missing); i += batchSize {
+		end := i + batchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batch := missing[i:end]
+		for _, id := range batch {
+			cache[id] = ""
+		}
+
+		table, _ := quoteIdentifier(lookup.Table)
+		rows, err := n.db.Query(fmt.Sprintf("SELECT `%s`, `%s` FROM %s WHERE `%s` IN (%s)",
+			lookup.IDColumn, lookup.NameColumn, table, lookup.IDColumn, joinIDs(batch)))
+		if err != nil {
+			return fmt.Errorf("%s lookup: %v", kind, err)
+		}
+		for rows.Next() {
+			var id int
+			var name sql.NullString
+			err = rows.Scan(&id, &name)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("%s lookup: %v", kind, err)
+			}
+			cache[id] = name.String
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("%s lookup: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+// Name returns the display name of id, or "" when there is none. A lookup that fails
+// is logged and disabled for the rest of the run, so listings still print.
+func (n *NameLookups) Name(kind string, id int) string {
+	if !n.Enabled(kind) {
+		return ""
+	}
+	err := n.Load(kind, []int{id})
+	if err != nil {
+		n.disable(kind, err)
+		return ""
+	}
+	return n.cache[kind][id]
+}
+
+func (n *NameLookups) disable(kind string, err error) {
+	n.logger.Printf("Disabling %s name lookup: %v", kind, err)
+	fmt.Printf("Warning: %v, showing ids only\n", err)
+	delete(n.lookups, kind)
+}
+
+// Label returns the id followed by its name, shortened to fit a listing column
+func (n *NameLookups) Label(kind string, id int) string {
+	label := strconv.Itoa(id)
+	name := []rune(n.Name(kind, id))
+	if len(name) > 20 {
+		name = append(name[:19], '…')
+	}
+	if len(name) > 0 {
+		label += " " + string(name)
+	}
+	return label
+}
+
+// Width returns the listing column width for kind, wider when names are shown
+func (n *NameLookups) Width(kind string, width int) int {
+	if n.Enabled(kind) {
+		return 32
+	}
+	return width
+}
+
+// loadReport fetches the names of all foreign keys of the report in batches
+func (n *NameLookups) loadReport(report *CleanupReport) {
+	ids := make(map[string][]int)
+	balanceIDs(ids, report.ZeroBalanceGroups)
+	balanceIDs(ids, report.RemainingBalances)
+	for _, j := range report.JournalRows {
+		ids["item"] = append(ids["item"], j.ItemFk)
+		ids["location"] = append(ids["location"], j.LocationFk)
+		ids["shop"] = append(ids["shop"], j.ShopFk)
+		ids["partner"] = append(ids["partner"], j.PartnerFk)
+	}
+	for _, f := range report.FIFOReductions {
+		ids["item"] = append(ids["item"], f.Record.ItemFk)
+		ids["location"] = append(ids["location"], f.Record.LocationFk)
+		ids["shop"] = append(ids["shop"], f.Record.ShopFk)
+		ids["partner"] = append(ids["partner"], f.Record.PartnerFk)
+	}
+	for _, d := range report.DetailReductions {
+		ids["shop"] = append(ids["shop"], d.ShopFk)
+	}
+	for _, h := range report.OrphanedHeaders {
+		ids["partner"] = append(ids["partner"], h.PartnerFk)
+	}
+
+	n.loadAll(ids)
+}
+
+// loadBalances fetches the names of all foreign keys of the balance groups in batches
+func (n *NameLookups) loadBalances(balances []ItemBalance) {
+	ids := make(map[string][]int)
+	balanceIDs(ids, balances)
+	n.loadAll(ids)
+}
+
+func (n *NameLookups) loadAll(ids map[string][]int) {
+	for kind, kindIDs := range ids {
+		err := n.Load(kind, kindIDs)
+		if err != nil {
+			n.disable(kind, err)
+		}
+	}
+}
+
+// balanceIDs adds the item, location and shop ids of balance groups to ids
+func balanceIDs(ids map[string][]int, balances []ItemBalance) {
+	for _, b := range balances {
+		ids["item"] = append(ids["item"], b.ItemFk)
+		ids["location"] = append(ids["location"], b.LocationFk)
+		ids["shop"] = append(ids["shop"], b.ShopFk)
+	}
+}
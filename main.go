@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -13,6 +16,14 @@ func main() {
 		log.Fatal("Error loading configuration:", err)
 	}
 
+	// First argument selects the command, cleanup is the default
+	command := "cleanup"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
 	// Setup logging
 	logger, logFile, err := SetupLogger(config.LogFile)
 	if err != nil {
@@ -20,8 +31,6 @@ func main() {
 	}
 	defer logFile.Close()
 
-	logger.Printf("Starting cleanup process with cutoff date: %s, DryRun: %v", config.CutoffDate, config.DryRun)
-
 	// Connect to database
 	db, err := ConnectDatabase(config)
 	if err != nil {
@@ -29,19 +38,188 @@ func main() {
 	}
 	defer db.Close()
 
+	// Create cleanup service
+	cleanupService := NewCleanupService(db, logger, config)
+
+	// Setup archiving for the commands that delete or update rows
+	if command == "cleanup" || command == "repair" || command == "purge" {
+		archiver, err := NewArchiver(db, logger, config)
+		if err != nil {
+			log.Fatal("Failed to setup archive:", err)
+		}
+		defer archiver.Close()
+		cleanupService.SetArchiver(archiver)
+	}
+
+	switch command {
+	case "cleanup":
+		runCleanup(config, cleanupService, logger, args)
+	case "audit":
+		runAudit(cleanupService, logger, args)
+	case "repair":
+		runRepair(config, cleanupService, logger, args)
+	case "purge":
+		runPurge(config, cleanupService, logger, args)
+	case "restore":
+		runRestore(config, cleanupService, logger, args)
+	case "report":
+		runReport(config, cleanupService, logger, args)
+	default:
+		log.Fatalf("Unknown command %q (use cleanup, audit, repair, purge, restore or report)", command)
+	}
+}
+
+// runCleanup runs the cleanup steps
+func runCleanup(config *Config, cleanupService *CleanupService, logger *log.Logger, args []string) {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	emitSQL := flags.String("emit-sql", "", "write the statements to this .sql file, with an undo script, instead of committing them")
+	reportFormat := flags.String("report-format", "", "write the candidate lists as csv, json and/or html (comma-separated)")
+	reportDir := flags.String("report-dir", ".", "directory for the --report-format files")
+	flags.Parse(args)
+
+	reportFormats, err := ParseReportFormats(*reportFormat)
+	if err != nil {
+		log.Fatal("Invalid --report-format:", err)
+	}
+
+	// Emitting SQL runs the real deletion path in a transaction that is rolled back
+	if *emitSQL != "" {
+		config.DryRun = false
+		err = cleanupService.StartSession(true)
+		if err != nil {
+			log.Fatal("Error starting transaction:", err)
+		}
+		defer cleanupService.EndSession()
+	} else if config.Simulate {
+		config.DryRun = false
+		err = cleanupService.StartSession(false)
+		if err != nil {
+			log.Fatal("Error starting transaction:", err)
+		}
+		defer cleanupService.EndSession()
+	}
+
+	logger.Printf("Starting cleanup process with cutoff date: %s, DryRun: %v", config.CutoffDate, config.DryRun)
+
+	// Resolve cutoff date expression
+	cutoffDate, err := cleanupService.ResolveCutoffDate(config, time.Now())
+	if err != nil {
+		log.Fatal("Invalid cutoff date:", err)
+	}
+	cutoff := cutoffDate.Format("2006-01-02")
+	logger.Printf("Resolved cutoff date %q to %s", config.CutoffDate, cutoff)
+
 	fmt.Printf("Connected to database successfully\n")
-	fmt.Printf("Cutoff date: %s\n", config.CutoffDate)
+	if cutoff == config.CutoffDate {
+		fmt.Printf("Cutoff date: %s\n", cutoff)
+	} else {
+		fmt.Printf("Cutoff date: %s (resolved from %q)\n", cutoff, config.CutoffDate)
+	}
 	fmt.Printf("Dry run mode: %v\n", config.DryRun)
+	if config.Simulate && *emitSQL == "" {
+		fmt.Println("Simulate mode: the real cleanup runs in a transaction that is rolled back at the end")
+		logger.Println("Simulate mode, all changes are rolled back at the end")
+	}
+	if *emitSQL != "" {
+		fmt.Printf("Emit SQL mode: statements are written to %s and rolled back\n", *emitSQL)
+		logger.Printf("Emit SQL mode, writing statements to %s", *emitSQL)
+	}
+	if config.SoftDelete {
+		fmt.Printf("Soft delete: rows are marked in %s instead of deleted\n", config.SoftDeleteColumn)
+		logger.Printf("Soft delete enabled (column %s, run %s)", config.SoftDeleteColumn, config.RunID)
+	}
 	fmt.Printf("Log file: %s\n", config.LogFile)
 
-	// Parse cutoff date
-	cutoffDate, err := time.Parse("2006-01-02", config.CutoffDate)
+	// Load legal holds
+	legalHolds, err := cleanupService.LoadLegalHolds(config.LegalHoldTable, config.LegalHoldFile)
 	if err != nil {
-		log.Fatal("Invalid cutoff date format. Use YYYY-MM-DD:", err)
+		log.Fatal("Error loading legal holds:", err)
+	}
+	if legalHolds.Count() > 0 {
+		fmt.Printf("Legal holds: %d entries\n", legalHolds.Count())
+		logger.Printf("Loaded %d legal hold entries", legalHolds.Count())
 	}
 
-	// Create cleanup service
-	cleanupService := NewCleanupService(db, logger)
+	// Parse retention policy by form type
+	retentionPolicy, err := ParseRetentionPolicy(config.RetentionPolicy, config.RetentionDefault)
+	if err != nil {
+		log.Fatal("Invalid retention policy:", err)
+	}
+	now := time.Now()
+	report := &CleanupReport{
+		RunID:       config.RunID,
+		Cutoff:      cutoff,
+		DryRun:      config.DryRun || config.Simulate || *emitSQL != "",
+		GeneratedAt: now.Format("2006-01-02 15:04:05"),
+	}
+
+	// The compliance report is written step by step and labels deletions that are not committed
+	var compliance *ComplianceReport
+	if retentionPolicy.Enabled() {
+		status := "deleted"
+		switch {
+		case *emitSQL != "":
+			status = "not committed (emit-sql)"
+		case config.Simulate:
+			status = "not committed (simulate)"
+		case config.DryRun:
+			status = "not committed (dry run)"
+		case config.SoftDelete:
+			status = "soft-deleted"
+		}
+		compliance, err = CreateComplianceReport(config.ComplianceReport, status)
+		if err != nil {
+			log.Fatal("Error creating compliance report:", err)
+		}
+	}
+	writeCompliance := func(entries []ComplianceEntry) {
+		err := compliance.Write(entries)
+		if err != nil {
+			log.Fatal("Error writing compliance report:", err)
+		}
+	}
+
+	// ============================================================
+	// STEP 0: Clean up orphaned journal rows
+	// ============================================================
+	fmt.Println("\n=== STEP 0: Cleaning up orphaned journal rows ===")
+	logger.Println("STEP 0: Starting orphaned journal cleanup")
+
+	orphanedJournals, err := cleanupService.FindOrphanedJournals(cutoffDate)
+	if err != nil {
+		log.Fatal("Error finding orphaned journal rows:", err)
+	}
+
+	var heldJournals []SkippedRecord
+	orphanedJournals, heldJournals = cleanupService.ExcludeHeldJournals(orphanedJournals, legalHolds, "orphaned-journal")
+	ReportSkippedRecords(logger, heldJournals, config.DryRun)
+
+	fmt.Printf("Found %d orphaned journal records (missing form_detail or NULL referenceFk)\n", len(orphanedJournals))
+	logger.Printf("Found %d orphaned journal records", len(orphanedJournals))
+
+	if len(orphanedJournals) > 0 {
+		ShowOrphanedJournalBreakdown(orphanedJournals)
+
+		if config.DryRun {
+			fmt.Println("\n=== DRY RUN MODE - No actual deletion will occur ===")
+			ShowOrphanedJournals(orphanedJournals, cleanupService.Names())
+			logger.Println("Dry run for orphaned journal rows completed")
+		} else if err := cleanupService.CheckArchive("orphaned journal cleanup"); err != nil {
+			fmt.Printf("Skipping orphaned journal deletion: %v\n", err)
+			logger.Printf("Orphaned journal cleanup skipped: %v", err)
+		} else {
+			err = cleanupService.DeleteOrphanedJournals(orphanedJournals)
+			if err != nil {
+				log.Fatal("Error deleting orphaned journal rows:", err)
+			}
+
+			fmt.Println("Orphaned journal cleanup completed successfully!")
+			logger.Printf("Orphaned journal cleanup completed. Deleted %d journal records", len(orphanedJournals))
+		}
+	} else {
+		fmt.Println("No orphaned journal records found.")
+		logger.Println("No orphaned journal records found")
+	}
 
 	// ============================================================
 	// STEP 1: Clean up zero-balance items (journal + form_detail)
@@ -55,9 +233,10 @@ func main() {
 		log.Fatal("Error finding zero balance items:", err)
 	}
 
-	fmt.Printf("Found %d item locations with zero balance on or before %s\n", len(zeroBalanceItems), config.CutoffDate)
+	fmt.Printf("Found %d item locations with zero balance on or before %s\n", len(zeroBalanceItems), cutoff)
 	logger.Printf("Found %d item locations with zero balance", len(zeroBalanceItems))
 
+	report.ZeroBalanceGroups = zeroBalanceItems
 	if len(zeroBalanceItems) > 0 {
 		// Get records to delete
 		recordsToDelete, err := cleanupService.GetRecordsToDelete(zeroBalanceItems, cutoffDate)
@@ -65,18 +244,68 @@ func main() {
 			log.Fatal("Error identifying records to delete:", err)
 		}
 
+		// Keep the latest rows per item/shop for price history
+		if config.RetainLastRows > 0 || config.RetainLastMonths > 0 {
+			var retainedCount int
+			recordsToDelete, retainedCount, err = cleanupService.ApplyRetentionRule(recordsToDelete, config.RetainLastRows, config.RetainLastMonths)
+			if err != nil {
+				log.Fatal("Error applying retention rule:", err)
+			}
+			fmt.Printf("Retention rule kept %d journal records (last %d rows / %d months per item and shop)\n",
+				retainedCount, config.RetainLastRows, config.RetainLastMonths)
+			logger.Printf("Retention rule kept %d journal records", retainedCount)
+		}
+
+		// Exclude balance groups under legal hold
+		var skipped []SkippedRecord
+		recordsToDelete, skipped = cleanupService.ExcludeHeldRecords(recordsToDelete, legalHolds, "zero-balance")
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+
+		// Exclude balance groups with documents still under retention
+		recordsToDelete, skipped = cleanupService.ApplyRetentionPolicy(recordsToDelete, retentionPolicy, now, "zero-balance")
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+
+		// Keep location transfers atomic
+		var blockedTransfers []BlockedTransfer
+		recordsToDelete, skipped, blockedTransfers, err = cleanupService.ExcludeUnpairedTransfers(recordsToDelete, "zero-balance")
+		if err != nil {
+			log.Fatal("Error checking transfer pairs:", err)
+		}
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+		ShowBlockedTransfers(blockedTransfers, cleanupService.Names())
+		LogBlockedTransfers(logger, blockedTransfers)
+
+		entries := retentionPolicy.ComplianceEntries(recordsToDelete, now, "zero-balance")
+
+		// Work out which headers lose all their details
+		detailReductions, err := cleanupService.PlanDetailReductions(recordsToDelete)
+		if err != nil {
+			log.Fatal("Error planning form_detail reductions:", err)
+		}
+		report.JournalRows = append(report.JournalRows, recordsToDelete...)
+		report.DetailReductions = append(report.DetailReductions, detailReductions...)
+
+		headerCleanups, err := cleanupService.PlanHeaderCleanup(detailReductions)
+		if err != nil {
+			log.Fatal("Error planning form_header cleanup:", err)
+		}
+		stepEntries := append(entries, deletedDetailEntries(detailReductions, recordsToDelete, entries)...)
+		stepEntries = append(stepEntries, emptiedHeaderEntries(headerCleanups, entries)...)
+
 		// Show statistics
 		stats := CalculateStats(recordsToDelete)
 		fmt.Printf("Records that will be processed:\n")
 		fmt.Printf("  Journal records: %d\n", len(recordsToDelete))
 		fmt.Printf("  Form detail records: %d\n", stats.DetailRecords)
+		fmt.Printf("  Form header records: %d\n", stats.HeaderRecords)
 
 		logger.Printf("Records to process: %d journal, %d detail", 
 			len(recordsToDelete), stats.DetailRecords)
 
 		if config.DryRun {
 			fmt.Println("\n=== DRY RUN MODE - No actual deletion will occur ===")
-			ShowDryRunResults(recordsToDelete)
+			ShowDryRunResults(recordsToDelete, cleanupService.Names())
+			ShowHeaderCleanup(headerCleanups, true)
 			logger.Println("Dry run for zero-balance items completed")
 		} else {
 			// Perform deletion
@@ -84,34 +313,216 @@ func main() {
 			if err != nil {
 				log.Fatal("Error performing deletion:", err)
 			}
+			ShowHeaderCleanup(headerCleanups, false)
+			LogHeaderCleanup(logger, headerCleanups)
 
 			fmt.Println("Zero-balance items cleanup completed successfully!")
 			logger.Printf("Zero-balance cleanup completed. Deleted %d journal and %d detail records", 
 				len(recordsToDelete), stats.DetailRecords)
 		}
+		writeCompliance(stepEntries)
 	} else {
 		fmt.Println("No items with zero balance found.")
 		logger.Println("No zero-balance items found for cleanup")
 	}
 
 	// ============================================================
-	// STEP 2: Clean up orphaned headers
+	// STEP 1b: FIFO matching for groups with non-zero balance
 	// ============================================================
-	fmt.Println("\n=== STEP 2: Cleaning up orphaned headers ===")
-	logger.Println("STEP 2: Starting orphaned headers cleanup")
+	if config.MatchingMode == "fifo" {
+		fmt.Println("\n=== STEP 1b: FIFO matching of non-zero balance groups ===")
+		logger.Println("STEP 1b: Starting FIFO matching")
+
+		candidates, err := cleanupService.FindNonZeroBalanceRecords(cutoffDate)
+		if err != nil {
+			log.Fatal("Error finding non-zero balance groups:", err)
+		}
+
+		var skipped []SkippedRecord
+		candidates, skipped = cleanupService.ExcludeHeldRecords(candidates, legalHolds, "fifo")
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+		candidates, skipped = cleanupService.ApplyRetentionPolicy(candidates, retentionPolicy, now, "fifo")
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+
+		reductions := PlanFIFOMatching(candidates)
+
+		// Keep location transfers atomic
+		var blockedTransfers []BlockedTransfer
+		reductions, skipped, blockedTransfers, err = cleanupService.ExcludeUnpairedFIFOReductions(reductions, "fifo")
+		if err != nil {
+			log.Fatal("Error checking transfer pairs:", err)
+		}
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+		ShowBlockedTransfers(blockedTransfers, cleanupService.Names())
+		LogBlockedTransfers(logger, blockedTransfers)
+
+		var matched []DeletedRecord
+		for _, reduction := range reductions {
+			matched = append(matched, reduction.Record)
+		}
+		detailReductions, err := cleanupService.PlanFIFODetailReductions(reductions)
+		if err != nil {
+			log.Fatal("Error planning form_detail reductions:", err)
+		}
+		report.FIFOReductions = append(report.FIFOReductions, reductions...)
+		report.DetailReductions = append(report.DetailReductions, detailReductions...)
+		entries := retentionPolicy.ComplianceEntries(matched, now, "fifo")
+		stepEntries := append(entries, deletedDetailEntries(detailReductions, matched, entries)...)
+
+		fmt.Printf("FIFO matching found %d journal records to delete or reduce\n", len(reductions))
+		logger.Printf("FIFO matching found %d journal records to delete or reduce", len(reductions))
+
+		if len(reductions) > 0 {
+			if config.DryRun {
+				fmt.Println("\n=== DRY RUN MODE - No actual deletion will occur ===")
+				ShowFIFOReductions(reductions, cleanupService.Names())
+				logger.Println("Dry run for FIFO matching completed")
+			} else {
+				err = cleanupService.PerformFIFOReduction(reductions)
+				if err != nil {
+					log.Fatal("Error performing FIFO reduction:", err)
+				}
+
+				fmt.Println("FIFO matching cleanup completed successfully!")
+				logger.Printf("FIFO matching cleanup completed. Processed %d journal records", len(reductions))
+			}
+		}
+		writeCompliance(stepEntries)
+	}
+
+	// ============================================================
+	// STEP 1b: Zero-crossing cleanup for groups with non-zero balance
+	// ============================================================
+	if config.MatchingMode == "zero-crossing" {
+		fmt.Println("\n=== STEP 1b: Cleaning up history up to the last zero balance ===")
+		logger.Println("STEP 1b: Starting zero-crossing cleanup")
+
+		crossingRecords, err := cleanupService.FindZeroCrossingRecords(cutoffDate)
+		if err != nil {
+			log.Fatal("Error finding zero-crossing records:", err)
+		}
+
+		var skipped []SkippedRecord
+		crossingRecords, skipped = cleanupService.ExcludeHeldRecords(crossingRecords, legalHolds, "zero-crossing")
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+		crossingRecords, skipped = cleanupService.ApplyRetentionPolicy(crossingRecords, retentionPolicy, now, "zero-crossing")
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+
+		var blockedTransfers []BlockedTransfer
+		crossingRecords, skipped, blockedTransfers, err = cleanupService.ExcludeUnpairedTransfers(crossingRecords, "zero-crossing")
+		if err != nil {
+			log.Fatal("Error checking transfer pairs:", err)
+		}
+		ReportSkippedRecords(logger, skipped, config.DryRun)
+		ShowBlockedTransfers(blockedTransfers, cleanupService.Names())
+		LogBlockedTransfers(logger, blockedTransfers)
+
+		entries := retentionPolicy.ComplianceEntries(crossingRecords, now, "zero-crossing")
+
+		stats := CalculateStats(crossingRecords)
+		fmt.Printf("Found %d journal records (%d form_detail) up to the last zero balance on or before %s\n",
+			len(crossingRecords), stats.DetailRecords, cutoff)
+		logger.Printf("Zero-crossing records to process: %d journal, %d detail", len(crossingRecords), stats.DetailRecords)
+
+		if len(crossingRecords) > 0 {
+			detailReductions, err := cleanupService.PlanDetailReductions(crossingRecords)
+			if err != nil {
+				log.Fatal("Error planning form_detail reductions:", err)
+			}
+			report.JournalRows = append(report.JournalRows, crossingRecords...)
+			report.DetailReductions = append(report.DetailReductions, detailReductions...)
+
+			headerCleanups, err := cleanupService.PlanHeaderCleanup(detailReductions)
+			if err != nil {
+				log.Fatal("Error planning form_header cleanup:", err)
+			}
+			stepEntries := append(entries, deletedDetailEntries(detailReductions, crossingRecords, entries)...)
+			stepEntries = append(stepEntries, emptiedHeaderEntries(headerCleanups, entries)...)
+
+			if config.DryRun {
+				fmt.Println("\n=== DRY RUN MODE - No actual deletion will occur ===")
+				ShowDryRunResults(crossingRecords, cleanupService.Names())
+				ShowHeaderCleanup(headerCleanups, true)
+				logger.Println("Dry run for zero-crossing cleanup completed")
+			} else {
+				err = cleanupService.PerformDeletion(crossingRecords)
+				if err != nil {
+					log.Fatal("Error performing zero-crossing deletion:", err)
+				}
+				ShowHeaderCleanup(headerCleanups, false)
+				LogHeaderCleanup(logger, headerCleanups)
+
+				fmt.Println("Zero-crossing cleanup completed successfully!")
+				logger.Printf("Zero-crossing cleanup completed. Deleted %d journal records", len(crossingRecords))
+			}
+			writeCompliance(stepEntries)
+		}
+	}
+
+	// ============================================================
+	// STEP 2: Clean up zero-quantity form_detail
+	// ============================================================
+	fmt.Println("\n=== STEP 2: Cleaning up zero-quantity form_detail ===")
+	logger.Println("STEP 2: Starting zero-quantity form_detail cleanup")
+
+	zeroQtyDetails, err := cleanupService.FindZeroQuantityDetails()
+	if err != nil {
+		log.Fatal("Error finding zero-quantity form_detail:", err)
+	}
+
+	var skipped []SkippedRecord
+	zeroQtyDetails, skipped = cleanupService.ExcludeHeldDetails(zeroQtyDetails, legalHolds, "zero-qty")
+	ReportSkippedRecords(logger, skipped, config.DryRun)
+
+	fmt.Printf("Found %d form_detail records with quantity = 0\n", len(zeroQtyDetails))
+	logger.Printf("Found %d zero-quantity form_detail records", len(zeroQtyDetails))
+
+	if len(zeroQtyDetails) > 0 {
+		if config.DryRun {
+			fmt.Println("\n=== DRY RUN MODE - No actual deletion will occur ===")
+			ShowZeroQuantityDetails(zeroQtyDetails, cleanupService.Names())
+			logger.Println("Dry run for zero-quantity form_detail completed")
+		} else {
+			err = cleanupService.DeleteZeroQuantityDetails(zeroQtyDetails)
+			if err != nil {
+				log.Fatal("Error deleting zero-quantity form_detail:", err)
+			}
+
+			fmt.Println("Zero-quantity form_detail cleanup completed successfully!")
+			logger.Printf("Zero-quantity cleanup completed. Deleted %d form_detail records", len(zeroQtyDetails))
+		}
+	} else {
+		fmt.Println("No zero-quantity form_detail found.")
+		logger.Println("No zero-quantity form_detail found")
+	}
+
+	// ============================================================
+	// STEP 3: Clean up orphaned headers
+	// ============================================================
+	fmt.Println("\n=== STEP 3: Cleaning up orphaned headers ===")
+	logger.Println("STEP 3: Starting orphaned headers cleanup")
 
 	orphanedHeaders, err := cleanupService.FindOrphanedHeaders()
 	if err != nil {
 		log.Fatal("Error finding orphaned headers:", err)
 	}
 
+	orphanedHeaders, skipped = cleanupService.ExcludeHeldHeaders(orphanedHeaders, legalHolds, "orphaned")
+	ReportSkippedRecords(logger, skipped, config.DryRun)
+
+	var headerEntries []ComplianceEntry
+	orphanedHeaders, skipped, headerEntries = cleanupService.ApplyRetentionPolicyToHeaders(orphanedHeaders, retentionPolicy, now, "orphaned")
+	ReportSkippedRecords(logger, skipped, config.DryRun)
+
+	report.OrphanedHeaders = orphanedHeaders
+
 	fmt.Printf("Found %d orphaned form_header records (no associated form_detail)\n", len(orphanedHeaders))
 	logger.Printf("Found %d orphaned headers", len(orphanedHeaders))
 
 	if len(orphanedHeaders) > 0 {
 		if config.DryRun {
 			fmt.Println("\n=== DRY RUN MODE - No actual deletion will occur ===")
-			ShowOrphanedHeaders(orphanedHeaders)
+			ShowOrphanedHeaders(orphanedHeaders, cleanupService.Names())
 			logger.Println("Dry run for orphaned headers completed")
 		} else {
 			err = cleanupService.DeleteOrphanedHeaders(orphanedHeaders)
@@ -122,20 +533,75 @@ func main() {
 			fmt.Println("Orphaned headers cleanup completed successfully!")
 			logger.Printf("Orphaned headers cleanup completed. Deleted %d headers", len(orphanedHeaders))
 		}
+		writeCompliance(headerEntries)
 	} else {
 		fmt.Println("No orphaned headers found.")
 		logger.Println("No orphaned headers found")
 	}
 
 	// ============================================================
-	// STEP 3: Show summary
+	// STEP 4: Show summary
 	// ============================================================
-	fmt.Println("\n=== STEP 3: Summary ===")
+	fmt.Println("\n=== STEP 4: Summary ===")
 	err = cleanupService.ShowRemainingBalance()
 	if err != nil {
 		log.Fatal("Error showing remaining balance:", err)
 	}
 
+	if compliance != nil {
+		err = compliance.Close()
+		if err != nil {
+			log.Fatal("Error writing compliance report:", err)
+		}
+		fmt.Printf("\nCompliance report: %s (%d entries, %s)\n", config.ComplianceReport, compliance.count, compliance.status)
+		logger.Printf("Compliance report written to %s with %d entries (%s)", config.ComplianceReport, compliance.count, compliance.status)
+	}
+
+	if len(reportFormats) > 0 {
+		report.RemainingBalances, err = cleanupService.FindBalances(BalanceFilter{})
+		if err != nil {
+			log.Fatal("Error finding remaining balances:", err)
+		}
+		files, err := WriteCleanupReport(report, cleanupService.Names(), *reportDir, reportFormats)
+		if err != nil {
+			log.Fatal("Error writing cleanup report:", err)
+		}
+		fmt.Println("\nCleanup report:")
+		for _, file := range files {
+			fmt.Printf("  %s\n", file)
+		}
+		logger.Printf("Cleanup report written: %s", strings.Join(files, ", "))
+	}
+
+	if *emitSQL != "" {
+		undoFile := strings.TrimSuffix(*emitSQL, ".sql") + "_undo.sql"
+		statements, undoStatements, err := cleanupService.EmitSQL(*emitSQL, undoFile)
+		if err != nil {
+			log.Fatal("Error writing SQL script:", err)
+		}
+		err = cleanupService.EndSession()
+		if err != nil {
+			log.Fatal("Error rolling back:", err)
+		}
+		fmt.Printf("\nSQL script: %s (%d statements)\n", *emitSQL, statements)
+		fmt.Printf("Undo script: %s (%d statements)\n", undoFile, undoStatements)
+		fmt.Println("No changes were committed.")
+		logger.Printf("Wrote %d statements to %s and %d undo statements to %s, changes rolled back",
+			statements, *emitSQL, undoStatements, undoFile)
+		return
+	}
+
+	if config.Simulate {
+		cleanupService.ShowSessionChanges()
+		err = cleanupService.EndSession()
+		if err != nil {
+			log.Fatal("Error rolling back:", err)
+		}
+		fmt.Println("\n✅ Simulation completed, all changes were rolled back")
+		logger.Println("Simulation completed, all changes rolled back")
+		return
+	}
+
 	fmt.Println("\n✅ All cleanup operations completed successfully!")
 	logger.Println("All cleanup operations completed successfully")
 }
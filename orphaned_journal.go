@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	orphanMissingDetail   = "missing form_detail"
+	orphanNullReferenceFk = "NULL referenceFk"
+)
+
+// FindOrphanedJournals returns journal rows on or before the cutoff date whose detailFk
+// points to a deleted form_detail, or inventory rows (accountFk = 2) without a referenceFk.
+// The header and partner come from the form_detail row as long as it physically exists,
+// so legal holds still apply to soft-deleted details.
+func (cs *CleanupService) FindOrphanedJournals(cutoffDate time.Time) ([]OrphanedJournal, error) {
+	query := fmt.Sprintf(`
+		SELECT 
+			j.id,
+			j.accountFk,
+			COALESCE(j.detailFk, 0),
+			COALESCE(fda.headerFk, 0),
+			COALESCE(fh.partnerFk, 0),
+			COALESCE(j.referenceFk, 0),
+			COALESCE(j.itemFk, 0),
+			COALESCE(j.locationFk, 0),
+			COALESCE(j.shopFk, 0),
+			COALESCE(j.type, 0),
+			COALESCE(j.quantity, 0),
+			j.journalDate,
+			CASE WHEN j.detailFk IS NOT NULL AND fd.id IS NULL THEN ? ELSE ? END as reason
+		FROM journal j
+		LEFT JOIN form_detail fd ON j.detailFk = fd.id AND %s
+		LEFT JOIN form_detail fda ON j.detailFk = fda.id
+		LEFT JOIN form_header fh ON fda.headerFk = fh.id
+		WHERE j.journalDate <= ?
+		  AND %s
+		  AND ((j.detailFk IS NOT NULL AND fd.id IS NULL)
+		    OR (j.accountFk = 2 AND j.referenceFk IS NULL))
+		ORDER BY j.id
+	`, cs.notDeleted("fd"), cs.notDeleted("j"))
+
+	rows, err := cs.conn().Query(query, orphanMissingDetail, orphanNullReferenceFk, cutoffDate.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var journals []OrphanedJournal
+	for rows.Next() {
+		var journal OrphanedJournal
+		err := rows.Scan(
+			&journal.ID,
+			&journal.AccountFk,
+			&journal.DetailFk,
+			&journal.HeaderID,
+			&journal.PartnerFk,
+			&journal.ReferenceFk,
+			&journal.ItemFk,
+			&journal.LocationFk,
+			&journal.ShopFk,
+			&journal.Type,
+			&journal.Quantity,
+			&journal.JournalDate,
+			&journal.Reason,
+		)
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, journal)
+	}
+
+	return journals, rows.Err()
+}
+
+// reducesDetail reports whether the row belongs to a live form_detail, whose quantity
+// must then be reduced like in PerformDeletion
+func (j OrphanedJournal) reducesDetail() bool {
+	return j.Reason == orphanNullReferenceFk && j.DetailFk != 0
+}
+
+// DeleteOrphanedJournals deletes the orphaned journal rows, archiving them to ARCHIVE_TARGET.
+// Inventory rows of a live form_detail reduce its quantity in the same transaction, and
+// headers left without details are deleted.
+func (cs *CleanupService) DeleteOrphanedJournals(journals []OrphanedJournal) error {
+	if len(journals) == 0 {
+		return nil
+	}
+	if err := cs.CheckArchive("orphaned journal cleanup"); err != nil {
+		return err
+	}
+
+	tx, err := cs.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var journalIDs []int
+	var removed []journalQuantity
+	headerSeen := make(map[int]bool)
+	var headerIDs []int
+	for _, journal := range journals {
+		journalIDs = append(journalIDs, journal.ID)
+		if !journal.reducesDetail() {
+			continue
+		}
+		removed = append(removed, journalQuantity{journal.DetailFk, journal.LocationFk, journal.Type, journal.Quantity})
+		if !headerSeen[journal.HeaderID] {
+			headerSeen[journal.HeaderID] = true
+			headerIDs = append(headerIDs, journal.HeaderID)
+		}
+	}
+
+	fmt.Printf("Deleting %d orphaned journal records...\n", len(journalIDs))
+	cs.logger.Printf("Deleting %d orphaned journal records: %v", len(journalIDs), journalIDs)
+
+	err = cs.deleteByIDs(tx, "journal", journalIDs)
+	if err != nil {
+		cs.logger.Printf("Error deleting orphaned journal records: %v", err)
+		return err
+	}
+
+	reducedDetails, err := cs.reduceDetailQuantities(tx, detailJournalQuantities(removed))
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.deleteEmptiedHeaders(tx, headerIDs)
+	if err != nil {
+		return err
+	}
+
+	err = cs.recalculateTotals(tx, reducedDetails, headerIDs)
+	if err != nil {
+		return err
+	}
+
+	err = cs.commit(tx)
+	if err != nil {
+		cs.logger.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// ExcludeHeldJournals removes orphaned journal rows for held headers, partners, items or dates
+func (cs *CleanupService) ExcludeHeldJournals(journals []OrphanedJournal, holds *LegalHolds, step string) ([]OrphanedJournal, []SkippedRecord) {
+	if holds.Count() == 0 {
+		return journals, nil
+	}
+
+	var kept []OrphanedJournal
+	var skipped []SkippedRecord
+	for _, journal := range journals {
+		if reason, held := holds.Match(journal.HeaderID, journal.PartnerFk, journal.ItemFk, journal.JournalDate); held {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "journal", ID: journal.ID, Reason: reason})
+			continue
+		}
+		kept = append(kept, journal)
+	}
+
+	return kept, skipped
+}
+
+// ShowOrphanedJournalBreakdown displays orphaned journal counts per account and reason
+func ShowOrphanedJournalBreakdown(journals []OrphanedJournal) {
+	type breakdownKey struct {
+		AccountFk int
+		Reason    string
+	}
+
+	counts := make(map[breakdownKey]int)
+	var keys []breakdownKey
+	for _, journal := range journals {
+		key := breakdownKey{journal.AccountFk, journal.Reason}
+		if _, ok := counts[key]; !ok {
+			keys = append(keys, key)
+		}
+		counts[key]++
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].AccountFk != keys[j].AccountFk {
+			return keys[i].AccountFk < keys[j].AccountFk
+		}
+		return keys[i].Reason < keys[j].Reason
+	})
+
+	fmt.Println("\nOrphaned journal records per account:")
+	fmt.Printf("%-10s %-22s %-10s\n", "AccountFk", "Reason", "Records")
+	fmt.Println(strings.Repeat("-", 45))
+	for _, key := range keys {
+		fmt.Printf("%-10d %-22s %-10d\n", key.AccountFk, key.Reason, counts[key])
+	}
+}
+
+// ShowOrphanedJournals displays orphaned journal rows that would be deleted
+func ShowOrphanedJournals(journals []OrphanedJournal, names *NameLookups) {
+	itemWidth := names.Width("item", 8)
+
+	fmt.Println("\nOrphaned journal records that would be deleted:")
+	fmt.Printf("%-10s %-10s %-10s %-10s %-*s %-12s %-20s\n",
+		"JournalID", "AccountFk", "DetailFk", "RefFk", itemWidth, "Item", "Date", "Reason")
+	fmt.Println(strings.Repeat("-", 82+itemWidth))
+
+	count := 0
+	for _, journal := range journals {
+		if count >= 20 {
+			fmt.Printf("... and %d more records\n", len(journals)-20)
+			break
+		}
+		fmt.Printf("%-10d %-10d %-10d %-10d %-*s %-12s %-20s\n",
+			journal.ID, journal.AccountFk, journal.DetailFk, journal.ReferenceFk, itemWidth, names.Label("item", journal.ItemFk),
+			dateOnly(journal.JournalDate), journal.Reason)
+		count++
+	}
+}
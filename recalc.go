@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// RecalcRule sets a quantity-derived column from a SQL expression
+type RecalcRule struct {
+	Column     string
+	Expression string
+}
+
+// ParseRecalcRules parses "column=expression" pairs separated by semicolons, e.g.
+// "subtotal=quantity*price;tax=subtotal*taxRate/100". Rules are applied in order.
+func ParseRecalcRules(spec string) ([]RecalcRule, error) {
+	var rules []RecalcRule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid recalculation rule %q (use column=expression)", entry)
+		}
+		column := strings.TrimSpace(parts[0])
+		if !identifierPattern.MatchString(column) || strings.Contains(column, ".") {
+			return nil, fmt.Errorf("invalid column %q in recalculation rule", column)
+		}
+		expression := strings.TrimSpace(parts[1])
+		if strings.Contains(expression, "--") || strings.Contains(expression, "/*") {
+			return nil, fmt.Errorf("comments are not allowed in recalculation rule %q", entry)
+		}
+		if err := checkRecalcExpression(expression); err != nil {
+			return nil, fmt.Errorf("invalid expression in recalculation rule %q: %v", entry, err)
+		}
+		rules = append(rules, RecalcRule{Column: column, Expression: expression})
+	}
+	return rules, nil
+}
+
+// recalcFunctions may be called in a recalculation expression, the aggregates in header rules
+var recalcFunctions = map[string]bool{
+	"SUM": true, "MIN": true, "MAX": true, "AVG": true, "COUNT": true,
+	"ROUND": true, "ABS": true, "COALESCE": true,
+}
+
+// checkRecalcExpression tokenizes an expression that goes into the UPDATE as SQL and accepts
+// only column names, optionally qualified with fd., numbers, the operators + - * /,
+// parentheses and calls of recalcFunctions with comma-separated arguments
+func checkRecalcExpression(expression string) error {
+	const (
+		start = iota
+		operand
+		operator
+		function
+	)
+	previous := start
+	var calls []bool // per open parenthesis, whether it holds function arguments
+
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(expression) && expression[j] >= '0' && expression[j] <= '9' {
+				j++
+			}
+			if j < len(expression) && expression[j] == '.' {
+				j++
+				digits := j
+				for j < len(expression) && expression[j] >= '0' && expression[j] <= '9' {
+					j++
+				}
+				if j == digits {
+					return fmt.Errorf("invalid number %q", expression[i:j])
+				}
+			}
+			if previous == operand || previous == function {
+				return fmt.Errorf("unexpected number %q", expression[i:j])
+			}
+			i, previous = j, operand
+			continue
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(expression) && isIdentifierByte(expression[j]) {
+				j++
+			}
+			name := expression[i:j]
+			if j < len(expression) && expression[j] == '.' {
+				if name != "fd" {
+					return fmt.Errorf("columns can only be qualified with fd., not %q", name)
+				}
+				j++
+				column := j
+				for j < len(expression) && isIdentifierByte(expression[j]) {
+					j++
+				}
+				if j == column || expression[column] >= '0' && expression[column] <= '9' {
+					return fmt.Errorf("invalid column %q", expression[i:j])
+				}
+				name = expression[i:j]
+			}
+			if previous == operand || previous == function {
+				return fmt.Errorf("unexpected %q", name)
+			}
+
+			k := j
+			for k < len(expression) && (expression[k] == ' ' || expression[k] == '\t') {
+				k++
+			}
+			if k < len(expression) && expression[k] == '(' {
+				if !recalcFunctions[strings.ToUpper(name)] {
+					return fmt.Errorf("function %s is not allowed", name)
+				}
+				i, previous = k, function
+				continue
+			}
+			i, previous = j, operand
+			continue
+
+		case c == '+' || c == '-' || c == '*' || c == '/':
+			unary := c == '+' || c == '-'
+			if previous != operand && !(unary && previous != function) {
+				return fmt.Errorf("unexpected %q", string(c))
+			}
+			previous = operator
+
+		case c == '(':
+			if previous == operand {
+				return fmt.Errorf("unexpected \"(\"")
+			}
+			calls = append(calls, previous == function)
+			previous = start
+
+		case c == ')':
+			if len(calls) == 0 || previous != operand {
+				return fmt.Errorf("unexpected \")\"")
+			}
+			calls = calls[:len(calls)-1]
+			previous = operand
+
+		case c == ',':
+			if len(calls) == 0 || !calls[len(calls)-1] || previous != operand {
+				return fmt.Errorf("unexpected \",\"")
+			}
+			previous = operator
+
+		default:
+			return fmt.Errorf("character %q is not allowed", string(c))
+		}
+		i++
+	}
+
+	if len(calls) > 0 {
+		return fmt.Errorf("unclosed \"(\"")
+	}
+	if previous != operand {
+		return fmt.Errorf("incomplete expression")
+	}
+	return nil
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func recalcColumns(rules []RecalcRule) []string {
+	var columns []string
+	for _, rule := range rules {
+		columns = append(columns, rule.Column)
+	}
+	return columns
+}
+
+// recalculateTotals re-derives the configured form_detail columns of the reduced details
+// and the configured form_header totals of their headers, logging before/after values
+func (cs *CleanupService) recalculateTotals(tx dbExecutor, detailIDs []int, headerIDs []int) error {
+	detailRules := cs.config.DetailRecalcRules
+	headerRules := cs.config.HeaderRecalcRules
+
+	if len(detailRules) > 0 && len(detailIDs) > 0 {
+		var assignments []string
+		for _, rule := range detailRules {
+			assignments = append(assignments, fmt.Sprintf("`%s` = %s", rule.Column, rule.Expression))
+		}
+		setClause := strings.Join(assignments, ", ")
+
+		err := cs.updateWithLogging(tx, "form_detail", detailIDs, recalcColumns(detailRules), func(inClause string) string {
+			return fmt.Sprintf("UPDATE form_detail SET %s WHERE id IN (%s)", setClause, inClause)
+		})
+		if err != nil {
+			cs.logger.Printf("Error recalculating form_detail totals: %v", err)
+			return err
+		}
+		fmt.Printf("Recalculated totals of %d form_detail records\n", len(detailIDs))
+	}
+
+	if len(headerRules) > 0 && len(headerIDs) > 0 {
+		// The reduced details were archived before their quantity update, the headers are archived here
+		err := cs.archiveUpdates(tx, "form_header", headerIDs)
+		if err != nil {
+			cs.logger.Printf("Error archiving form_header records: %v", err)
+			return err
+		}
+
+		var assignments []string
+		for _, rule := range headerRules {
+			assignments = append(assignments, fmt.Sprintf(
+				"`%s` = (SELECT COALESCE(%s, 0) FROM form_detail fd WHERE fd.headerFk = fh.id AND %s)",
+				rule.Column, rule.Expression, cs.notDeleted("fd")))
+		}
+		setClause := strings.Join(assignments, ", ")
+
+		err = cs.updateWithLogging(tx, "form_header", headerIDs, recalcColumns(headerRules), func(inClause string) string {
+			return fmt.Sprintf("UPDATE form_header fh SET %s WHERE fh.id IN (%s)", setClause, inClause)
+		})
+		if err != nil {
+			cs.logger.Printf("Error recalculating form_header totals: %v", err)
+			return err
+		}
+		fmt.Printf("Recalculated totals of %d form_header records\n", len(headerIDs))
+	}
+
+	return nil
+}
+
+// updateWithLogging runs the update built for each batch of IDs and logs the
+// before/after values of the given columns
+func (cs *CleanupService) updateWithLogging(tx dbExecutor, tableName string, ids []int, columns []string, buildQuery func(inClause string) string) error {
+	batchSize := 1000
+	for i := 0; i < len(ids); i += batchSize {
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch := ids[i:end]
+		inClause := ""
+		for j, id := range batch {
+			if j > 0 {
+				inClause += ","
+			}
+			inClause += fmt.Sprintf("%d", id)
+		}
+
+		before, err := selectColumnValues(tx, tableName, inClause, columns)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(buildQuery(inClause))
+		if err != nil {
+			return err
+		}
+
+		after, err := selectColumnValues(tx, tableName, inClause, columns)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range batch {
+			oldValues, ok := before[id]
+			if !ok {
+				continue
+			}
+			var changes []string
+			for c, column := range columns {
+				changes = append(changes, fmt.Sprintf("%s %s -> %s", column, oldValues[c], after[id][c]))
+			}
+			cs.logger.Printf("%s ID %d recalculated: %s", tableName, id, strings.Join(changes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// selectColumnValues reads the given columns of the rows in inClause as strings
+func selectColumnValues(q dbExecutor, tableName string, inClause string, columns []string) (map[int][]string, error) {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = "`" + column + "`"
+	}
+
+	rows, err := q.Query(fmt.Sprintf("SELECT id, %s FROM %s WHERE id IN (%s)",
+		strings.Join(quoted, ", "), tableName, inClause))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[int][]string)
+	for rows.Next() {
+		var id int
+		raw := make([]sql.NullString, len(columns))
+		dest := []any{&id}
+		for i := range raw {
+			dest = append(dest, &raw[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := make([]string, len(columns))
+		for i, value := range raw {
+			row[i] = "NULL"
+			if value.Valid {
+				row[i] = value.String
+			}
+		}
+		values[id] = row
+	}
+
+	return values, rows.Err()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRecalcRules(t *testing.T) {
+	rules, err := ParseRecalcRules(" subtotal=quantity*price ; tax=(subtotal - discountAmount) * taxRate / 100;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RecalcRule{
+		{Column: "subtotal", Expression: "quantity*price"},
+		{Column: "tax", Expression: "(subtotal - discountAmount) * taxRate / 100"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ParseRecalcRules = %+v, want %+v", rules, want)
+	}
+}
+
+func TestCheckRecalcExpression(t *testing.T) {
+	for _, expression := range []string{
+		"quantity*price",
+		"-quantity * 1.5",
+		"subtotal*discountPct/100",
+		"(subtotal-discountAmount)*taxRate/100",
+		"SUM(fd.subtotal)",
+		"SUM(fd.subtotal-fd.discountAmount+fd.tax)",
+		"ROUND(SUM(fd.quantity * fd.price), 2)",
+		"coalesce (MAX(fd.price), 0)",
+		"price * -(quantity + 1)",
+	} {
+		if err := checkRecalcExpression(expression); err != nil {
+			t.Errorf("checkRecalcExpression(%q): %v", expression, err)
+		}
+	}
+}
+
+func TestCheckRecalcExpressionRejectsSQL(t *testing.T) {
+	for expression, want := range map[string]string{
+		"(SELECT password FROM users LIMIT 1)": `unexpected "password"`,
+		"price; DROP TABLE journal":            `character ";" is not allowed`,
+		"SLEEP(10)":                            "function SLEEP is not allowed",
+		"quantity * 'x'":                       `character "'" is not allowed`,
+		"users.password":                       "columns can only be qualified with fd.",
+		"price OR 1":                           `unexpected "OR"`,
+		"price * (quantity":                    `unclosed "("`,
+		"price)":                               `unexpected ")"`,
+		"price, quantity":                      `unexpected ","`,
+		"quantity *":                           "incomplete expression",
+		"quantity * / price":                   `unexpected "/"`,
+		"`quantity`":                           "character \"`\" is not allowed",
+		"price 2":                              `unexpected number "2"`,
+		"1.":                                   `invalid number "1."`,
+		"fd.1price":                            `invalid column "fd.1price"`,
+		"@var":                                 `character "@" is not allowed`,
+	} {
+		err := checkRecalcExpression(expression)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("checkRecalcExpression(%q) error = %v, want %s", expression, err, want)
+		}
+	}
+
+	if _, err := ParseRecalcRules("total=price; DELETE FROM journal"); err == nil {
+		t.Error("ParseRecalcRules accepted a second statement")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// detailJournalQuantity is the quantity of a form_detail according to its inventory journal rows j.
+// A location transfer books the same quantity out of one location and into another, so only the
+// incoming side counts; the detail is recognised the same way as in findTransferRows.
+const detailJournalQuantity = `CASE
+				WHEN COUNT(DISTINCT j.locationFk) > 1 AND MIN(j.type) < 0 AND MAX(j.type) > 0
+				THEN SUM(CASE WHEN j.type > 0 THEN j.quantity ELSE 0 END)
+				ELSE SUM(j.quantity)
+			END`
+
+// FindQuantityRepairs returns every form_detail whose quantity differs from the quantity
+// of its inventory journal rows. Details without journal rows are left alone.
+func (cs *CleanupService) FindQuantityRepairs() ([]QuantityRepair, error) {
+	query := fmt.Sprintf(`
+		SELECT 
+			fd.id,
+			fd.headerFk,
+			fd.quantity,
+			%s as journal_quantity
+		FROM form_detail fd
+		INNER JOIN journal j ON j.detailFk = fd.id AND j.accountFk = 2 AND %s
+		WHERE %s
+		GROUP BY fd.id, fd.headerFk, fd.quantity
+		HAVING ABS(fd.quantity - journal_quantity) > 0.001
+		ORDER BY fd.id
+	`, detailJournalQuantity, cs.notDeleted("j"), cs.notDeleted("fd"))
+
+	rows, err := cs.conn().Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var repairs []QuantityRepair
+	for rows.Next() {
+		var repair QuantityRepair
+		err := rows.Scan(&repair.DetailID, &repair.HeaderID, &repair.OldQuantity, &repair.NewQuantity)
+		if err != nil {
+			return nil, err
+		}
+		repairs = append(repairs, repair)
+	}
+
+	return repairs, rows.Err()
+}
+
+// ApplyQuantityRepairs archives the affected form_detail rows to ARCHIVE_TARGET and sets
+// their quantity to the journal quantity in a single transaction
+func (cs *CleanupService) ApplyQuantityRepairs(repairs []QuantityRepair) error {
+	if len(repairs) == 0 {
+		return nil
+	}
+	if err := cs.CheckArchive("repair"); err != nil {
+		return err
+	}
+
+	tx, err := cs.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var detailIDs []int
+	for _, repair := range repairs {
+		detailIDs = append(detailIDs, repair.DetailID)
+	}
+
+	if cs.archiving() {
+		fmt.Printf("Archiving %d form_detail records (ARCHIVE_TARGET=%s)...\n", len(detailIDs), cs.config.ArchiveTarget)
+		cs.logger.Printf("Archiving %d form_detail records (run %s): %v", len(detailIDs), cs.config.RunID, detailIDs)
+	}
+
+	err = cs.archiver.Archive(tx, "form_detail", detailIDs)
+	if err != nil {
+		cs.logger.Printf("Error archiving form_detail records: %v", err)
+		return err
+	}
+
+	for _, repair := range repairs {
+		_, err := tx.Exec("UPDATE form_detail SET quantity = ? WHERE id = ?", repair.NewQuantity, repair.DetailID)
+		if err != nil {
+			cs.logger.Printf("Error repairing form_detail ID %d: %v", repair.DetailID, err)
+			return err
+		}
+		cs.logger.Printf("form_detail ID %d repaired: old_qty=%.3f, new_qty=%.3f",
+			repair.DetailID, repair.OldQuantity, repair.NewQuantity)
+	}
+
+	err = cs.commit(tx)
+	if err != nil {
+		cs.logger.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	fmt.Printf("Repaired %d form_detail quantities\n", len(repairs))
+	return nil
+}
+
+// ShowQuantityRepairs displays the quantity differences that would be corrected
+func ShowQuantityRepairs(repairs []QuantityRepair) {
+	fmt.Println("\nform_detail quantities that would be repaired:")
+	fmt.Printf("%-10s %-10s %-12s %-12s %-12s\n", "DetailID", "HeaderID", "CurrentQty", "JournalQty", "Diff")
+	fmt.Println(strings.Repeat("-", 60))
+
+	count := 0
+	for _, repair := range repairs {
+		if count >= 20 {
+			fmt.Printf("... and %d more records\n", len(repairs)-20)
+			break
+		}
+		fmt.Printf("%-10d %-10d %-12.3f %-12.3f %-12.3f\n",
+			repair.DetailID, repair.HeaderID, repair.OldQuantity, repair.NewQuantity,
+			repair.NewQuantity-repair.OldQuantity)
+		count++
+	}
+}
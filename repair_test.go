@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestCleanupLeavesNothingToRepair runs every cleanup path over a set of details and then
+// derives each detail's quantity from its remaining journal rows, as audit and repair do.
+// The cleanup arithmetic must leave no differences behind.
+func TestCleanupLeavesNothingToRepair(t *testing.T) {
+	record := func(journalID, detailID, location, typ int, quantity float64) DeletedRecord {
+		return DeletedRecord{JournalID: journalID, DetailID: detailID, HeaderID: 100 + detailID,
+			LocationFk: location, ShopFk: 1, Type: typ, Quantity: quantity}
+	}
+	journal := map[int]DeletedRecord{
+		// Purchase of 10 in two rows, the row of 6 has a zero balance
+		1: record(1, 1, 5, 1, 6),
+		2: record(2, 1, 5, 1, 4),
+		// Transfer of 3 from location 5 to 6, both sides are deleted together
+		3: record(3, 2, 5, -1, 3),
+		4: record(4, 2, 6, 1, 3),
+		// Sale of 8, FIFO takes 2 off the row of 5
+		5: record(5, 3, 5, -1, 5),
+		6: record(6, 3, 5, -1, 3),
+		// Sale of 3, the row of 2 is orphaned
+		7: record(7, 4, 5, -1, 2),
+		8: record(8, 4, 5, -1, 1),
+	}
+	details := map[int]float64{1: 10, 2: 3, 3: 8, 4: 3}
+	reduce := func(reducedBy map[int]float64) {
+		for detailID, quantity := range reducedBy {
+			details[detailID] -= quantity
+		}
+	}
+
+	deleted := []DeletedRecord{journal[1], journal[3], journal[4]}
+	reduce(recordReductions(deleted))
+	for _, r := range deleted {
+		delete(journal, r.JournalID)
+	}
+
+	fifo := []JournalReduction{{Record: journal[5], Removed: 2, NewQuantity: 3}}
+	reduce(fifoReductions(fifo))
+	sale := journal[5]
+	sale.Quantity = 3
+	journal[5] = sale
+
+	orphan := journal[7]
+	reduce(detailJournalQuantities([]journalQuantity{{orphan.DetailID, orphan.LocationFk, orphan.Type, orphan.Quantity}}))
+	delete(journal, 7)
+
+	var remaining []journalQuantity
+	for _, r := range journal {
+		remaining = append(remaining, journalQuantity{r.DetailID, r.LocationFk, r.Type, r.Quantity})
+	}
+	journalQuantities := detailJournalQuantities(remaining)
+
+	for detailID, quantity := range details {
+		if quantity <= 0.001 {
+			if _, ok := journalQuantities[detailID]; ok {
+				t.Errorf("form_detail %d is deleted but still has journal rows", detailID)
+			}
+			continue
+		}
+		if diff := math.Abs(quantity - journalQuantities[detailID]); diff > 0.001 {
+			t.Errorf("audit finds form_detail %d at %.3f, journal quantity %.3f", detailID, quantity, journalQuantities[detailID])
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reportFormats are the formats accepted by --report-format
+var reportFormats = []string{"csv", "json", "html", "xlsx"}
+
+// reportTable is one candidate list in a format-neutral shape shared by the report writers.
+// ShopColumn is the index of shopFk (-1 when the list has none) and SumColumns the
+// numeric columns totalled per shop.
+type reportTable struct {
+	Name       string
+	Title      string
+	Sheet      string
+	Columns    []string
+	Rows       [][]any
+	ShopColumn int
+	SumColumns []int
+	names      *NameLookups
+}
+
+// reportInfo is the title and the run details shown above the tables of a report
+type reportInfo struct {
+	Title  string
+	Fields []reportField
+}
+
+// reportField is one run detail, under Key in JSON and Label elsewhere
+type reportField struct {
+	Key   string
+	Label string
+	Value any
+}
+
+// ParseReportFormats parses a comma-separated --report-format value
+func ParseReportFormats(spec string) ([]string, error) {
+	var formats []string
+	for _, format := range strings.Split(spec, ",") {
+		format = strings.TrimSpace(strings.ToLower(format))
+		if format == "" {
+			continue
+		}
+		valid := false
+		for _, known := range reportFormats {
+			if format == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown report format %q (use %s)", format, strings.Join(reportFormats, ", "))
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+func (r *CleanupReport) info() reportInfo {
+	return reportInfo{
+		Title: "Cleanup report",
+		Fields: []reportField{
+			{"run_id", "Run", r.RunID},
+			{"cutoff", "Cutoff", r.Cutoff},
+			{"dry_run", "Dry run", r.DryRun},
+			{"generated_at", "Generated", r.GeneratedAt},
+		},
+	}
+}
+
+// tables converts the candidate lists of the report into report tables, with a name column
+// after each foreign key that has a lookup
+func (r *CleanupReport) tables(names *NameLookups) []reportTable {
+	groups := reportTable{
+		Name:  "zero_balance_groups",
+		Title: "Zero-balance groups",
+		Sheet: "Zero-balance groups",
+		Columns: []string{"ReferenceFk", "ItemFk", "LocationFk", "ShopFk",
+			"TotalPurchases", "TotalSales", "NetBalance", "LastTxnDate"},
+		ShopColumn: 3,
+		SumColumns: []int{4, 5, 6},
+	}
+	for _, g := range r.ZeroBalanceGroups {
+		groups.Rows = append(groups.Rows, []any{g.ReferenceFk, g.ItemFk, g.LocationFk, g.ShopFk,
+			g.TotalPurchases, g.TotalSales, g.NetBalance, dateOnly(g.LastTxnDate)})
+	}
+
+	journals := reportTable{
+		Name:  "journal_rows",
+		Title: "Journal rows to delete",
+		Sheet: "Deleted journals",
+		Columns: []string{"JournalID", "DetailID", "HeaderID", "TxnDate", "ReferenceFk", "ItemFk",
+			"LocationFk", "ShopFk", "Type", "Quantity", "PartnerFk", "FormType", "FormDate"},
+		ShopColumn: 7,
+		SumColumns: []int{9},
+	}
+	for _, j := range r.JournalRows {
+		journals.Rows = append(journals.Rows, []any{j.JournalID, j.DetailID, j.HeaderID, dateOnly(j.TxnDate),
+			j.ReferenceFk, j.ItemFk, j.LocationFk, j.ShopFk, j.Type, j.Quantity, j.PartnerFk, j.FormType, dateOnly(j.FormDate)})
+	}
+
+	fifo := reportTable{
+		Name:  "fifo_reductions",
+		Title: "FIFO journal reductions",
+		Sheet: "FIFO reductions",
+		Columns: []string{"JournalID", "DetailID", "HeaderID", "TxnDate", "ReferenceFk", "ItemFk",
+			"LocationFk", "ShopFk", "Type", "Quantity", "Removed", "NewQuantity", "Delete"},
+		ShopColumn: 7,
+		SumColumns: []int{9, 10, 11},
+	}
+	for _, f := range r.FIFOReductions {
+		j := f.Record
+		fifo.Rows = append(fifo.Rows, []any{j.JournalID, j.DetailID, j.HeaderID, dateOnly(j.TxnDate), j.ReferenceFk,
+			j.ItemFk, j.LocationFk, j.ShopFk, j.Type, j.Quantity, f.Removed, f.NewQuantity, f.Delete})
+	}
+
+	// Details whose journal rows are already gone take the shop of the report's journal rows
+	shopByDetail := make(map[int]int)
+	for _, j := range r.JournalRows {
+		shopByDetail[j.DetailID] = j.ShopFk
+	}
+	for _, f := range r.FIFOReductions {
+		shopByDetail[f.Record.DetailID] = f.Record.ShopFk
+	}
+
+	reductions := reportTable{
+		Name:       "detail_reductions",
+		Title:      "form_detail reductions",
+		Sheet:      "Reduced details",
+		Columns:    []string{"DetailID", "HeaderID", "ShopFk", "OldQuantity", "ReducedBy", "NewQuantity", "Delete"},
+		ShopColumn: 2,
+		SumColumns: []int{3, 4, 5},
+	}
+	for _, d := range r.DetailReductions {
+		shop := d.ShopFk
+		if shop == 0 {
+			shop = shopByDetail[d.DetailID]
+		}
+		reductions.Rows = append(reductions.Rows, []any{d.DetailID, d.HeaderID, shop, d.OldQuantity, d.ReducedBy, d.NewQuantity, d.Delete})
+	}
+
+	// form_header has no shop and an orphaned header no journal rows left to take one from
+	headers := reportTable{
+		Name:       "orphaned_headers",
+		Title:      "Orphaned headers",
+		Sheet:      "Orphaned headers",
+		Columns:    []string{"ID", "HeaderNo", "FormDate", "PartnerFk", "FormType"},
+		ShopColumn: -1,
+	}
+	for _, h := range r.OrphanedHeaders {
+		headers.Rows = append(headers.Rows, []any{h.ID, h.HeaderNo, dateOnly(h.FormDate), h.PartnerFk, h.FormType})
+	}
+
+	remaining := reportTable{
+		Name:  "remaining_balances",
+		Title: "Remaining balances",
+		Sheet: "Remaining balances",
+		Columns: []string{"ReferenceFk", "ItemFk", "LocationFk", "ShopFk",
+			"TotalPurchases", "TotalSales", "NetBalance", "LastTxnDate"},
+		ShopColumn: 3,
+		SumColumns: []int{4, 5, 6},
+	}
+	for _, g := range r.RemainingBalances {
+		remaining.Rows = append(remaining.Rows, []any{g.ReferenceFk, g.ItemFk, g.LocationFk, g.ShopFk,
+			g.TotalPurchases, g.TotalSales, g.NetBalance, dateOnly(g.LastTxnDate)})
+	}
+
+	tables := []reportTable{groups, journals, fifo, reductions, headers, remaining}
+	for i := range tables {
+		tables[i] = tables[i].withNames(names)
+	}
+	return tables
+}
+
+// withNames inserts a name column after each foreign key column with a lookup,
+// shifting ShopColumn and SumColumns accordingly
+func (t reportTable) withNames(names *NameLookups) reportTable {
+	t.names = names
+
+	var insertAfter []int
+	for i, column := range t.Columns {
+		if names.Enabled(nameColumns[column]) {
+			insertAfter = append(insertAfter, i)
+		}
+	}
+	if len(insertAfter) == 0 {
+		return t
+	}
+
+	// newIndex maps an old column index to its index after the insertions
+	newIndex := make([]int, len(t.Columns))
+	shift := 0
+	var columns []string
+	for i, column := range t.Columns {
+		newIndex[i] = i + shift
+		columns = append(columns, column)
+		if shift < len(insertAfter) && insertAfter[shift] == i {
+			columns = append(columns, strings.TrimSuffix(column, "Fk")+"Name")
+			shift++
+		}
+	}
+
+	rows := make([][]any, len(t.Rows))
+	for r, row := range t.Rows {
+		var values []any
+		for i, value := range row {
+			values = append(values, value)
+			if kind := nameColumns[t.Columns[i]]; names.Enabled(kind) {
+				values = append(values, names.Name(kind, value.(int)))
+			}
+		}
+		rows[r] = values
+	}
+
+	t.Columns = columns
+	t.Rows = rows
+	if t.ShopColumn >= 0 {
+		t.ShopColumn = newIndex[t.ShopColumn]
+	}
+	sumColumns := make([]int, len(t.SumColumns))
+	for i, c := range t.SumColumns {
+		sumColumns[i] = newIndex[c]
+	}
+	t.SumColumns = sumColumns
+	return t
+}
+
+// shopTotals returns the row count and the sums of SumColumns per shop, ordered by shop
+func (t reportTable) shopTotals() reportTable {
+	totals := reportTable{
+		Name:       t.Name + "_shop_totals",
+		Title:      t.Title + " per shop",
+		Columns:    []string{t.Columns[t.ShopColumn], "Rows"},
+		ShopColumn: 0,
+	}
+	for _, c := range t.SumColumns {
+		totals.Columns = append(totals.Columns, t.Columns[c])
+	}
+
+	// Sums of columns holding only counts or flags stay integers
+	integral := make([]bool, len(t.SumColumns))
+	for i := range integral {
+		integral[i] = true
+	}
+
+	byShop := make(map[int][]float64)
+	for _, row := range t.Rows {
+		shop := row[t.ShopColumn].(int)
+		sums, ok := byShop[shop]
+		if !ok {
+			sums = make([]float64, len(t.SumColumns)+1)
+			byShop[shop] = sums
+		}
+		sums[0]++
+		for i, c := range t.SumColumns {
+			sums[i+1] += toFloat(row[c])
+			if _, ok := row[c].(float64); ok {
+				integral[i] = false
+			}
+		}
+	}
+
+	var shops []int
+	for shop := range byShop {
+		shops = append(shops, shop)
+	}
+	sort.Ints(shops)
+
+	for _, shop := range shops {
+		sums := byShop[shop]
+		row := []any{shop, int(sums[0])}
+		for i, sum := range sums[1:] {
+			if integral[i] {
+				row = append(row, int(sum))
+			} else {
+				row = append(row, sum)
+			}
+		}
+		totals.Rows = append(totals.Rows, row)
+	}
+	return totals.withNames(t.names)
+}
+
+// WriteCleanupReport writes the report in each format to dir and returns the written files
+func WriteCleanupReport(report *CleanupReport, names *NameLookups, dir string, formats []string) ([]string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	names.loadReport(report)
+	return writeReportFiles(filepath.Join(dir, "cleanup_"+report.RunID), report.info(), report.tables(names), formats)
+}
+
+// writeReportFiles writes the tables in each format to files named after base.
+// CSV gets one file per table, plus one with the per-shop totals of tables with a shop column.
+func writeReportFiles(base string, info reportInfo, tables []reportTable, formats []string) ([]string, error) {
+	var files []string
+	for _, format := range formats {
+		switch format {
+		case "csv":
+			for _, table := range tables {
+				csvTables := []reportTable{table}
+				if table.ShopColumn >= 0 {
+					csvTables = append(csvTables, table.shopTotals())
+				}
+				for _, csvTable := range csvTables {
+					filename := base + "_" + csvTable.Name + ".csv"
+					if err := writeReportCSV(filename, csvTable); err != nil {
+						return files, err
+					}
+					files = append(files, filename)
+				}
+			}
+		case "json":
+			filename := base + ".json"
+			if err := writeReportJSON(filename, info, tables); err != nil {
+				return files, err
+			}
+			files = append(files, filename)
+		case "html":
+			filename := base + ".html"
+			if err := writeReportHTML(filename, info, tables); err != nil {
+				return files, err
+			}
+			files = append(files, filename)
+		case "xlsx":
+			filename := base + ".xlsx"
+			if err := writeReportXLSX(filename, tables); err != nil {
+				return files, err
+			}
+			files = append(files, filename)
+		}
+	}
+	return files, nil
+}
+
+func writeReportCSV(filename string, table reportTable) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write(table.Columns)
+	for _, row := range table.Rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = formatReportValue(value)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func writeReportJSON(filename string, info reportInfo, tables []reportTable) error {
+	type jsonTable struct {
+		Name       string           `json:"name"`
+		Title      string           `json:"title"`
+		Rows       []map[string]any `json:"rows"`
+		ShopTotals []map[string]any `json:"shop_totals,omitempty"`
+	}
+	output := make(map[string]any)
+	for _, field := range info.Fields {
+		output[field.Key] = field.Value
+	}
+
+	var jsonTables []jsonTable
+	for _, table := range tables {
+		entry := jsonTable{Name: table.Name, Title: table.Title, Rows: tableObjects(table)}
+		if table.ShopColumn >= 0 {
+			entry.ShopTotals = tableObjects(table.shopTotals())
+		}
+		jsonTables = append(jsonTables, entry)
+	}
+	output["tables"] = jsonTables
+
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
+
+// tableObjects returns the rows of a table as objects keyed by column
+func tableObjects(table reportTable) []map[string]any {
+	objects := []map[string]any{}
+	for _, row := range table.Rows {
+		object := make(map[string]any, len(row))
+		for i, column := range table.Columns {
+			object[column] = row[i]
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+// htmlSection is a table of the HTML report with its per-shop totals
+type htmlSection struct {
+	Table  reportTable
+	Totals *reportTable
+}
+
+func writeReportHTML(filename string, info reportInfo, tables []reportTable) error {
+	var sections []htmlSection
+	for _, table := range tables {
+		section := htmlSection{Table: table}
+		if table.ShopColumn >= 0 {
+			totals := table.shopTotals()
+			section.Totals = &totals
+		}
+		sections = append(sections, section)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = htmlReportTemplate.Execute(file, struct {
+		Info     reportInfo
+		Sections []htmlSection
+	}{info, sections})
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// formatReportValue renders a report value as text, quantities with three decimals
+func formatReportValue(value any) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toFloat(value any) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	default:
+		return 0
+	}
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"cell": formatReportValue,
+	"numeric": func(value any) bool {
+		switch value.(type) {
+		case int, float64:
+			return true
+		}
+		return false
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Info.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; font-size: 13px; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; }
+th { background: #eee; cursor: pointer; user-select: none; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+td.num { text-align: right; }
+tr:nth-child(even) td { background: #fafafa; }
+h2 { margin-top: 1.5em; }
+h3 { font-size: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Info.Title}}</h1>
+<p>{{range $i, $field := .Info.Fields}}{{if $i}}, {{end}}{{$field.Label}}: {{cell $field.Value}}{{end}}</p>
+{{range .Sections}}
+<h2>{{.Table.Title}} ({{len .Table.Rows}})</h2>
+<table class="sortable">
+<thead><tr>{{range .Table.Columns}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Table.Rows}}<tr>{{range .}}<td{{if numeric .}} class="num"{{end}}>{{cell .}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+{{with .Totals}}
+<h3>{{.Title}}</h3>
+<table class="sortable">
+<thead><tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr>{{range .}}<td{{if numeric .}} class="num"{{end}}>{{cell .}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+{{end}}
+<script>
+document.querySelectorAll("table.sortable th").forEach(function (th) {
+  th.addEventListener("click", function () {
+    var table = th.closest("table");
+    var body = table.tBodies[0];
+    var index = Array.prototype.indexOf.call(th.parentNode.children, th);
+    var asc = !th.classList.contains("asc");
+    table.querySelectorAll("th").forEach(function (h) { h.classList.remove("asc", "desc"); });
+    th.classList.add(asc ? "asc" : "desc");
+    var rows = Array.prototype.slice.call(body.rows);
+    rows.sort(function (a, b) {
+      var x = a.cells[index].textContent, y = b.cells[index].textContent;
+      var number = /^-?\d+(\.\d+)?$/;
+      var cmp = (number.test(x) && number.test(y)) ? parseFloat(x) - parseFloat(y) : x.localeCompare(y);
+      return asc ? cmp : -cmp;
+    });
+    rows.forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReportFormats(t *testing.T) {
+	formats, err := ParseReportFormats(" HTML, csv,,xlsx ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(formats, []string{"html", "csv", "xlsx"}) {
+		t.Errorf("ParseReportFormats = %v", formats)
+	}
+
+	if _, err := ParseReportFormats("csv,pdf"); err == nil || !strings.Contains(err.Error(), `unknown report format "pdf"`) {
+		t.Errorf("ParseReportFormats(csv,pdf) error = %v, want unknown report format", err)
+	}
+}
+
+// testCleanupReport has a row in every list; detail 21 has no shop of its own
+func testCleanupReport() *CleanupReport {
+	journal := DeletedRecord{JournalID: 1, DetailID: 21, HeaderID: 200, TxnDate: "2024-01-31 00:00:00",
+		ReferenceFk: 1, ItemFk: 10, LocationFk: 5, ShopFk: 3, Type: 1, Quantity: 4, PartnerFk: 7, FormType: 1}
+	fifo := DeletedRecord{JournalID: 2, DetailID: 22, HeaderID: 201, TxnDate: "2024-02-01",
+		ReferenceFk: 2, ItemFk: 11, LocationFk: 6, ShopFk: 4, Type: -1, Quantity: 6}
+
+	return &CleanupReport{
+		RunID:             "20250101_120000",
+		Cutoff:            "2024-12-31",
+		DryRun:            true,
+		GeneratedAt:       "2025-01-01 12:00:00",
+		ZeroBalanceGroups: []ItemBalance{{ReferenceFk: 1, ItemFk: 10, LocationFk: 5, ShopFk: 3, TotalPurchases: 4, TotalSales: 4}},
+		JournalRows:       []DeletedRecord{journal},
+		FIFOReductions:    []JournalReduction{{Record: fifo, Removed: 2, NewQuantity: 4}},
+		DetailReductions: []DetailReduction{
+			{DetailID: 21, HeaderID: 200, OldQuantity: 4, ReducedBy: 4, Delete: true},
+			{DetailID: 22, HeaderID: 201, ShopFk: 4, OldQuantity: 6, ReducedBy: 2, NewQuantity: 4},
+		},
+		OrphanedHeaders:   []OrphanedHeader{{ID: 200, HeaderNo: "H-200", FormDate: "2024-01-31"}},
+		RemainingBalances: []ItemBalance{{ReferenceFk: 2, ItemFk: 11, LocationFk: 6, ShopFk: 4, TotalPurchases: 6, NetBalance: 4}},
+	}
+}
+
+func TestCleanupReportTablesHaveShopTotals(t *testing.T) {
+	tables := testCleanupReport().tables(nil)
+
+	var names []string
+	for _, table := range tables {
+		names = append(names, table.Name)
+		if table.Name == "orphaned_headers" {
+			if table.ShopColumn >= 0 {
+				t.Errorf("orphaned_headers has shop column %d, form_header has no shop", table.ShopColumn)
+			}
+			continue
+		}
+		if table.ShopColumn < 0 {
+			t.Errorf("%s has no shop column", table.Name)
+			continue
+		}
+		if len(table.Rows) == 0 {
+			t.Errorf("%s has no rows", table.Name)
+		}
+		for _, row := range table.Rows {
+			if shop := row[table.ShopColumn].(int); shop == 0 {
+				t.Errorf("%s: row %v has no shop", table.Name, row)
+			}
+		}
+		if totals := table.shopTotals(); len(totals.Rows) == 0 {
+			t.Errorf("%s has no per-shop totals", table.Name)
+		}
+	}
+
+	want := []string{"zero_balance_groups", "journal_rows", "fifo_reductions", "detail_reductions",
+		"orphaned_headers", "remaining_balances"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("tables = %v, want %v", names, want)
+	}
+}
+
+func TestWriteReportFiles(t *testing.T) {
+	report := testCleanupReport()
+	base := filepath.Join(t.TempDir(), "cleanup_"+report.RunID)
+	files, err := writeReportFiles(base, report.info(), report.tables(nil), reportFormats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Six lists, all but the orphaned headers with a shop totals CSV, then one JSON, HTML and XLSX file
+	if len(files) != 14 {
+		t.Errorf("wrote %d files, want 14: %v", len(files), files)
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.Size() == 0 {
+			t.Errorf("%s: %v, want a non-empty file", file, err)
+		}
+	}
+
+	data, err := os.ReadFile(base + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output struct {
+		RunID  string `json:"run_id"`
+		Tables []struct {
+			Name       string           `json:"name"`
+			Rows       []map[string]any `json:"rows"`
+			ShopTotals []map[string]any `json:"shop_totals"`
+		} `json:"tables"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.RunID != report.RunID || len(output.Tables) != 6 {
+		t.Fatalf("JSON report run %q with %d tables", output.RunID, len(output.Tables))
+	}
+	for _, table := range output.Tables {
+		if len(table.ShopTotals) == 0 && table.Name != "orphaned_headers" {
+			t.Errorf("JSON table %s has no shop totals", table.Name)
+		}
+	}
+
+	csvData, err := os.ReadFile(base + "_fifo_reductions.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "JournalID,DetailID,HeaderID,TxnDate,ReferenceFk,ItemFk,LocationFk,ShopFk,Type,Quantity,Removed,NewQuantity,Delete\n" +
+		"2,22,201,2024-02-01,2,11,6,4,-1,6.000,2.000,4.000,no\n"
+	if string(csvData) != wantCSV {
+		t.Errorf("FIFO CSV =\n%s\nwant\n%s", csvData, wantCSV)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cell styles of styles.xml, by index into cellXfs
+const (
+	xlsxStyleDefault = iota
+	xlsxStyleHeader
+	xlsxStyleNumber
+	xlsxStyleSubtotalLabel
+	xlsxStyleSubtotalNumber
+)
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="1"><numFmt numFmtId="164" formatCode="#,##0.000"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill><fill><patternFill patternType="solid"><fgColor rgb="FFEEEEEE"/></patternFill></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="5">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="2" borderId="0" xfId="0" applyFont="1" applyFill="1"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+<xf numFmtId="164" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1" applyNumberFormat="1"/>
+</cellXfs>
+</styleSheet>`
+
+// writeReportXLSX writes the report as a workbook with one sheet per table.
+// Rows of tables with a shop column are grouped by shop, each group followed by a subtotal row,
+// and the header row of every sheet is frozen.
+func writeReportXLSX(filename string, tables []reportTable) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	parts := map[string]string{
+		"_rels/.rels": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`,
+		"xl/styles.xml": xlsxStyles,
+	}
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+`)
+	workbook.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets>
+`)
+	workbookRels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+`)
+
+	for i, table := range tables {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`+"\n", n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`+"\n", xmlEscape(table.Sheet), n, n)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`+"\n", n, n)
+		parts[fmt.Sprintf("xl/worksheets/sheet%d.xml", n)] = xlsxSheet(table)
+	}
+
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets>
+</workbook>`)
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`, len(tables)+1)
+
+	parts["[Content_Types].xml"] = contentTypes.String()
+	parts["xl/workbook.xml"] = workbook.String()
+	parts["xl/_rels/workbook.xml.rels"] = workbookRels.String()
+
+	// Sorted names put [Content_Types].xml first
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(parts[name]))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// xlsxSheet builds the worksheet XML of one table
+func xlsxSheet(table reportTable) string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>
+`)
+
+	sb.WriteString("<cols>")
+	for i, width := range xlsxColumnWidths(table) {
+		fmt.Fprintf(&sb, `<col min="%d" max="%d" width="%d" customWidth="1"/>`, i+1, i+1, width)
+	}
+	sb.WriteString("</cols>\n<sheetData>\n")
+
+	sb.WriteString(`<row r="1">`)
+	for i, column := range table.Columns {
+		sb.WriteString(xlsxCell(i, 1, column, xlsxStyleHeader))
+	}
+	sb.WriteString("</row>\n")
+
+	rowNum := 2
+	writeRow := func(row []any) {
+		fmt.Fprintf(&sb, `<row r="%d">`, rowNum)
+		for i, value := range row {
+			style := xlsxStyleDefault
+			if _, ok := value.(float64); ok {
+				style = xlsxStyleNumber
+			}
+			sb.WriteString(xlsxCell(i, rowNum, value, style))
+		}
+		sb.WriteString("</row>\n")
+		rowNum++
+	}
+
+	if table.ShopColumn < 0 {
+		for _, row := range table.Rows {
+			writeRow(row)
+		}
+	} else {
+		rows := make([][]any, len(table.Rows))
+		copy(rows, table.Rows)
+		sort.SliceStable(rows, func(a, b int) bool {
+			return rows[a][table.ShopColumn].(int) < rows[b][table.ShopColumn].(int)
+		})
+
+		for start := 0; start < len(rows); {
+			shop := rows[start][table.ShopColumn].(int)
+			end := start
+			first := rowNum
+			for end < len(rows) && rows[end][table.ShopColumn].(int) == shop {
+				writeRow(rows[end])
+				end++
+			}
+			last := rowNum - 1
+
+			// SUBTOTAL skips other subtotals, so a grand total over the column stays correct
+			fmt.Fprintf(&sb, `<row r="%d">`, rowNum)
+			label := fmt.Sprintf("Shop %d", shop)
+			if name := table.names.Name("shop", shop); name != "" {
+				label += " " + name
+			}
+			sb.WriteString(xlsxCell(0, rowNum, fmt.Sprintf("%s subtotal (%d rows)", label, end-start), xlsxStyleSubtotalLabel))
+			for _, c := range table.SumColumns {
+				sum := 0.0
+				for _, row := range rows[start:end] {
+					sum += toFloat(row[c])
+				}
+				column := xlsxColumn(c)
+				fmt.Fprintf(&sb, `<c r="%s%d" s="%d"><f>SUBTOTAL(9,%s%d:%s%d)</f><v>%s</v></c>`,
+					column, rowNum, xlsxStyleSubtotalNumber, column, first, column, last, strconv.FormatFloat(sum, 'f', -1, 64))
+			}
+			sb.WriteString("</row>\n")
+			rowNum++
+			start = end
+		}
+	}
+
+	sb.WriteString("</sheetData>\n</worksheet>")
+	return sb.String()
+}
+
+// xlsxCell builds one cell; numbers are stored as numbers, everything else as inline strings
+func xlsxCell(column, row int, value any, style int) string {
+	ref := fmt.Sprintf("%s%d", xlsxColumn(column), row)
+	switch v := value.(type) {
+	case int:
+		return fmt.Sprintf(`<c r="%s" s="%d"><v>%d</v></c>`, ref, style, v)
+	case float64:
+		return fmt.Sprintf(`<c r="%s" s="%d"><v>%s</v></c>`, ref, style, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+
+	text := formatReportValue(value)
+	if text == "" {
+		return ""
+	}
+	return fmt.Sprintf(`<c r="%s" s="%d" t="inlineStr"><is><t>%s</t></is></c>`, ref, style, xmlEscape(text))
+}
+
+// xlsxColumn returns the column letters of a zero-based column index
+func xlsxColumn(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
+}
+
+// xlsxColumnWidths sizes each column to its longest value, within limits
+func xlsxColumnWidths(table reportTable) []int {
+	widths := make([]int, len(table.Columns))
+	for i, column := range table.Columns {
+		widths[i] = len(column) + 2
+	}
+	for _, row := range table.Rows {
+		for i, value := range row {
+			if width := len(formatReportValue(value)) + 2; width > widths[i] {
+				widths[i] = width
+			}
+		}
+	}
+	for i := range widths {
+		if widths[i] > 50 {
+			widths[i] = 50
+		}
+	}
+	return widths
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXLSXColumn(t *testing.T) {
+	for index, want := range map[int]string{0: "A", 9: "J", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(index); got != want {
+			t.Errorf("xlsxColumn(%d) = %s, want %s", index, got, want)
+		}
+	}
+}
+
+func TestWriteReportXLSX(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "report.xlsx")
+	tables := testCleanupReport().tables(nil)
+	if err := writeReportXLSX(filename, tables); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if archive.File[0].Name != "[Content_Types].xml" {
+		t.Errorf("first part is %s, want [Content_Types].xml", archive.File[0].Name)
+	}
+
+	parts := make(map[string]string)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[file.Name] = string(data)
+
+		// Every part must be well-formed XML
+		decoder := xml.NewDecoder(strings.NewReader(string(data)))
+		for {
+			_, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("%s: %v", file.Name, err)
+				break
+			}
+		}
+	}
+
+	for _, table := range tables {
+		if !strings.Contains(parts["xl/workbook.xml"], `<sheet name="`+table.Sheet+`"`) {
+			t.Errorf("workbook has no sheet %q", table.Sheet)
+		}
+	}
+
+	// FIFO reductions: shop 4 with Quantity, Removed and NewQuantity subtotals in J, K and L
+	fifo := parts["xl/worksheets/sheet3.xml"]
+	for _, want := range []string{"Shop 4 subtotal (1 rows)", "SUBTOTAL(9,J2:J2)", "SUBTOTAL(9,K2:K2)", "SUBTOTAL(9,L2:L2)"} {
+		if !strings.Contains(fifo, want) {
+			t.Errorf("FIFO sheet has no %q:\n%s", want, fifo)
+		}
+	}
+	if !strings.Contains(fifo, `state="frozen"`) {
+		t.Error("FIFO sheet header is not frozen")
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// restoreOrder inserts parents before children, the reverse of the deletion order
+var restoreOrder = []string{"form_header", "form_detail", "journal"}
+
+// ReadArchive reads and verifies the files of an archive run, from a local directory or
+// from s3://bucket/prefix/<run id>. Checksums and row counts must match the manifest,
+// and encrypted files need the key whose fingerprint the manifest records.
+// The values are converted to the types of the destination columns.
+func (cs *CleanupService) ReadArchive(source string) (*ArchiveManifest, []RestoreTable, error) {
+	readFile, err := cs.archiveReader(source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := readFile("manifest.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading manifest: %v", err)
+	}
+	var manifest ArchiveManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing manifest: %v", err)
+	}
+
+	var key *archiveKey
+	if manifest.Encryption != "" {
+		if manifest.Encryption != archiveEncryption {
+			return nil, nil, fmt.Errorf("unsupported archive encryption %q", manifest.Encryption)
+		}
+		key, err = loadArchiveKey(cs.config)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key == nil {
+			return nil, nil, fmt.Errorf("archive is encrypted, set ARCHIVE_KEY or ARCHIVE_KEY_FILE")
+		}
+		if key.fingerprint != manifest.KeyFingerprint {
+			return nil, nil, fmt.Errorf("archive key fingerprint %s does not match manifest (%s)",
+				key.fingerprint, manifest.KeyFingerprint)
+		}
+	}
+
+	files := make(map[string]ArchiveFile)
+	for _, file := range manifest.Files {
+		files[file.Table] = file
+	}
+
+	var tables []RestoreTable
+	for _, table := range restoreOrder {
+		file, ok := files[table]
+		if !ok {
+			continue
+		}
+		if len(file.Columns) == 0 {
+			return nil, nil, fmt.Errorf("%s: manifest lists no columns", file.File)
+		}
+		for _, column := range file.Columns {
+			if !identifierPattern.MatchString(column) || strings.Contains(column, ".") {
+				return nil, nil, fmt.Errorf("%s: invalid column name %q", file.File, column)
+			}
+		}
+
+		data, err := readArchiveParts(readFile, file)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows, err := readArchiveFile(data, file, manifest.Format, key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		types, err := cs.columnTypes(table, file.Columns)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s column types: %v", table, err)
+		}
+		for _, row := range rows {
+			for i := range row {
+				row[i], err = restoreValue(row[i], types[i])
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: column %s: %v", file.File, file.Columns[i], err)
+				}
+			}
+		}
+		tables = append(tables, RestoreTable{Table: table, Columns: file.Columns, Rows: rows})
+	}
+
+	return &manifest, tables, nil
+}
+
+// archiveReader returns a function reading the files of a run directory or an s3:// run prefix.
+// For S3 the bucket comes from the URL and the endpoint and credentials from the S3_* settings.
+func (cs *CleanupService) archiveReader(source string) (func(name string) ([]byte, error), error) {
+	if !strings.HasPrefix(source, "s3://") {
+		return func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(source, name))
+		}, nil
+	}
+
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(source, "s3://"), "/")
+	prefix = strings.Trim(prefix, "/")
+	if bucket == "" || prefix == "" {
+		return nil, fmt.Errorf("invalid archive source %q (use s3://bucket/prefix/<run id>)", source)
+	}
+
+	s3Config := *cs.config
+	s3Config.S3Bucket = bucket
+	client, err := newS3Client(&s3Config)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) ([]byte, error) {
+		return client.GetObject(path.Join(prefix, name))
+	}, nil
+}
+
+// readArchiveParts reads an archive file, or for an s3 run the objects it was uploaded as,
+// checking each part against its manifest checksum
+func readArchiveParts(readFile func(name string) ([]byte, error), file ArchiveFile) ([]byte, error) {
+	if len(file.Parts) == 0 {
+		return readFile(file.File)
+	}
+
+	var data []byte
+	for _, part := range file.Parts {
+		partData, err := readFile(part.File)
+		if err != nil {
+			return nil, err
+		}
+		if sha256Hex(partData) != part.SHA256 {
+			return nil, fmt.Errorf("%s: checksum does not match manifest", part.File)
+		}
+		data = append(data, partData...)
+	}
+	return data, nil
+}
+
+// readArchiveFile verifies one archive file against its manifest entry and parses its rows
+// in the column order of the manifest
+func readArchiveFile(data []byte, file ArchiveFile, format string, key *archiveKey) ([][]any, error) {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != file.SHA256 {
+		return nil, fmt.Errorf("%s: checksum does not match manifest", file.File)
+	}
+
+	var err error
+	if key != nil {
+		data, err = key.open(bytes.NewReader(data), file.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// gzip.Reader reads all concatenated members
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file.File, err)
+	}
+	defer zr.Close()
+
+	var rows [][]any
+	if format == "csv" {
+		rows, err = readCSVRows(zr, file.Columns)
+	} else {
+		rows, err = readJSONRows(zr, file.Columns)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file.File, err)
+	}
+
+	if len(rows) != file.Rows {
+		return nil, fmt.Errorf("%s: %d rows read, manifest lists %d", file.File, len(rows), file.Rows)
+	}
+	return rows, nil
+}
+
+// readJSONRows parses JSONL rows into the given column order, a missing key is NULL
+func readJSONRows(r io.Reader, columns []string) ([][]any, error) {
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	var rows [][]any
+	for {
+		var record map[string]any
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for column := range record {
+			if !known[column] {
+				return nil, fmt.Errorf("row %d: column %q is not in the manifest", len(rows)+1, column)
+			}
+		}
+
+		row := make([]any, len(columns))
+		for i, column := range columns {
+			if number, ok := record[column].(json.Number); ok {
+				row[i] = number.String()
+			} else {
+				row[i] = record[column]
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// readCSVRows parses CSV rows whose header line must match the manifest columns, \N is NULL
+func readCSVRows(r io.Reader, columns []string) ([][]any, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	if strings.Join(records[0], ",") != strings.Join(columns, ",") {
+		return nil, fmt.Errorf("header %v does not match manifest columns %v", records[0], columns)
+	}
+
+	var rows [][]any
+	for _, record := range records[1:] {
+		row := make([]any, len(record))
+		for i, value := range record {
+			if value == `\N` {
+				row[i] = nil
+			} else {
+				row[i] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// columnTypes returns the database type names of the given columns of a production table
+func (cs *CleanupService) columnTypes(tableName string, columns []string) ([]string, error) {
+	rows, err := cs.db.Query(fmt.Sprintf("SELECT `%s` FROM %s LIMIT 0", strings.Join(columns, "`,`"), tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	types := make([]string, len(columnTypes))
+	for i, columnType := range columnTypes {
+		types[i] = columnType.DatabaseTypeName()
+	}
+	return types, nil
+}
+
+// restoreValue converts an archived text value to the Go type matching the column type.
+// DECIMAL, date and text columns keep the exact archived text.
+func restoreValue(value any, typeName string) (any, error) {
+	text, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+
+	switch strings.TrimPrefix(typeName, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR":
+		if strings.HasPrefix(typeName, "UNSIGNED ") {
+			return strconv.ParseUint(text, 10, 64)
+		}
+		return strconv.ParseInt(text, 10, 64)
+	case "FLOAT", "DOUBLE":
+		return strconv.ParseFloat(text, 64)
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT":
+		return []byte(text), nil
+	default:
+		return text, nil
+	}
+}
+
+// RestoreArchive puts the archived rows back into the production tables in one transaction.
+// Deleted rows are inserted again. Rows that still exist were only updated by the run, like
+// the form_detail quantities set by repair, and get their archived values back.
+// A row archived more than once in a run is restored to its first, oldest copy.
+func (cs *CleanupService) RestoreArchive(tables []RestoreTable) error {
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		if len(table.Rows) == 0 {
+			continue
+		}
+
+		rows, err := firstRowsByID(table.Columns, table.Rows)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table.Table, err)
+		}
+		inserts, updates, err := splitExistingRows(tx, table.Table, table.Columns, rows)
+		if err != nil {
+			cs.logger.Printf("Error reading existing %s rows: %v", table.Table, err)
+			return err
+		}
+
+		placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(table.Columns)), ",") + ")"
+		batchSize := 1000
+		for i := 0; i < len(inserts); i += batchSize {
+			end := i + batchSize
+			if end > len(inserts) {
+				end = len(inserts)
+			}
+
+			values := make([]string, 0, end-i)
+			var args []any
+			for _, row := range inserts[i:end] {
+				values = append(values, placeholders)
+				args = append(args, row...)
+			}
+
+			_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (`%s`) VALUES %s",
+				table.Table, strings.Join(table.Columns, "`,`"), strings.Join(values, ",")), args...)
+			if err != nil {
+				cs.logger.Printf("Error restoring %s rows: %v", table.Table, err)
+				return err
+			}
+		}
+
+		for _, row := range updates {
+			query, args := restoreUpdate(table.Table, table.Columns, row)
+			_, err = tx.Exec(query, args...)
+			if err != nil {
+				cs.logger.Printf("Error restoring %s rows: %v", table.Table, err)
+				return err
+			}
+		}
+
+		cs.logger.Printf("Restored %d %s rows (%d inserted, %d updated)", len(rows), table.Table, len(inserts), len(updates))
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		cs.logger.Printf("Error committing restore: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// idColumn returns the position of the id column
+func idColumn(columns []string) (int, error) {
+	for i, column := range columns {
+		if column == "id" {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("archive has no id column")
+}
+
+// firstRowsByID drops the later copies of rows archived more than once, keeping the archive order
+func firstRowsByID(columns []string, rows [][]any) ([][]any, error) {
+	idIndex, err := idColumn(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(rows))
+	var result [][]any
+	for _, row := range rows {
+		id := fmt.Sprint(row[idIndex])
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// splitExistingRows separates the rows to insert from the rows whose id is still in the table
+func splitExistingRows(tx dbExecutor, tableName string, columns []string, rows [][]any) ([][]any, [][]any, error) {
+	idIndex, err := idColumn(columns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := make(map[string]bool)
+	batchSize := 1000
+	for i := 0; i < len(rows); i += batchSize {
+		end := i + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var args []any
+		for _, row := range rows[i:end] {
+			args = append(args, row[idIndex])
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+		result, err := tx.Query(fmt.Sprintf("SELECT id FROM %s WHERE id IN (%s)", tableName, placeholders), args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for result.Next() {
+			var id string
+			if err := result.Scan(&id); err != nil {
+				result.Close()
+				return nil, nil, err
+			}
+			existing[id] = true
+		}
+		err = result.Err()
+		result.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var inserts, updates [][]any
+	for _, row := range rows {
+		if existing[fmt.Sprint(row[idIndex])] {
+			updates = append(updates, row)
+		} else {
+			inserts = append(inserts, row)
+		}
+	}
+	return inserts, updates, nil
+}
+
+// restoreUpdate builds the UPDATE setting every column of an existing row back to its archived value
+func restoreUpdate(tableName string, columns []string, row []any) (string, []any) {
+	var assignments []string
+	var args []any
+	var id any
+	for i, column := range columns {
+		if column == "id" {
+			id = row[i]
+			continue
+		}
+		assignments = append(assignments, fmt.Sprintf("`%s` = ?", column))
+		args = append(args, row[i])
+	}
+	return fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", tableName, strings.Join(assignments, ", ")), append(args, id)
+}
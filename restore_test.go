@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestArchive archives the rows of one table with a file archiver and returns the manifest entry
+func writeTestArchive(t *testing.T, config *Config, table string, columns []string, rows [][]any) ArchiveFile {
+	archiver, err := newFileArchiver(config, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { archiver.Close() })
+
+	out, err := archiver.open(table, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.writeMember(out, columns, rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.writeManifest(); err != nil {
+		t.Fatal(err)
+	}
+	return archiver.manifest().Files[0]
+}
+
+func TestReadArchiveFileKeepsManifestColumnOrder(t *testing.T) {
+	columns := []string{"id", "quantity", "journalDate", "comment"}
+	rows := [][]any{
+		{int64(1), []byte("2.500"), []byte("2024-01-31"), nil},
+		{int64(2), []byte("-1.000"), []byte("2024-02-01"), []byte("moved")},
+	}
+	want := [][]any{
+		{"1", "2.500", "2024-01-31", nil},
+		{"2", "-1.000", "2024-02-01", "moved"},
+	}
+
+	for _, format := range []string{"jsonl", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			config := testS3Config(t, "")
+			config.ArchiveFormat = format
+			file := writeTestArchive(t, config, "journal", columns, rows)
+			if !reflect.DeepEqual(file.Columns, columns) {
+				t.Fatalf("manifest columns = %v, want %v", file.Columns, columns)
+			}
+
+			cs := &CleanupService{config: config}
+			readFile, err := cs.archiveReader(filepath.Join(config.ArchiveDir, config.RunID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := readFile(file.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := readArchiveFile(data, file, format, nil)
+			if err != nil {
+				t.Fatalf("readArchiveFile: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("rows = %v, want %v", got, want)
+			}
+
+			data[len(data)-1] ^= 0xff
+			if _, err := readArchiveFile(data, file, format, nil); err == nil || !strings.Contains(err.Error(), "checksum") {
+				t.Errorf("readArchiveFile of a modified file: error = %v, want a checksum error", err)
+			}
+		})
+	}
+}
+
+func TestReadJSONRows(t *testing.T) {
+	columns := []string{"id", "quantity", "comment"}
+	for _, tt := range []struct {
+		name    string
+		input   string
+		want    [][]any
+		wantErr string
+	}{
+		{
+			name:  "manifest order",
+			input: `{"quantity":"1.5","comment":"a","id":3}` + "\n",
+			want:  [][]any{{"3", "1.5", "a"}},
+		},
+		{
+			name:  "missing key is NULL",
+			input: `{"id":4,"quantity":"2"}` + "\n" + `{"id":5,"quantity":"1","comment":null}` + "\n",
+			want:  [][]any{{"4", "2", nil}, {"5", "1", nil}},
+		},
+		{
+			name:    "unknown key",
+			input:   `{"id":6,"quantity":"1","extra":"x"}` + "\n",
+			wantErr: `column "extra" is not in the manifest`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readJSONRows(strings.NewReader(tt.input), columns)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCSVRowsRejectsHeaderMismatch(t *testing.T) {
+	_, err := readCSVRows(strings.NewReader("quantity,id\n1,2\n"), []string{"id", "quantity"})
+	if err == nil || !strings.Contains(err.Error(), "does not match manifest columns") {
+		t.Errorf("error = %v, want a header mismatch", err)
+	}
+}
+
+func TestRestoreValue(t *testing.T) {
+	for _, tt := range []struct {
+		value    any
+		typeName string
+		want     any
+	}{
+		{nil, "INT", nil},
+		{"42", "INT", int64(42)},
+		{"-3", "BIGINT", int64(-3)},
+		{"18446744073709551615", "UNSIGNED BIGINT", uint64(18446744073709551615)},
+		{"1", "TINYINT", int64(1)},
+		{"0.25", "DOUBLE", 0.25},
+		{"12.345", "DECIMAL", "12.345"},
+		{"2024-01-31 10:00:00", "DATETIME", "2024-01-31 10:00:00"},
+		{"text", "VARCHAR", "text"},
+		{"\x00\x01", "VARBINARY", []byte{0, 1}},
+		{true, "TINYINT", true},
+	} {
+		got, err := restoreValue(tt.value, tt.typeName)
+		if err != nil {
+			t.Errorf("restoreValue(%q, %s): %v", tt.value, tt.typeName, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("restoreValue(%q, %s) = %#v, want %#v", tt.value, tt.typeName, got, tt.want)
+		}
+	}
+
+	if _, err := restoreValue("1.5", "INT"); err == nil {
+		t.Error("restoreValue(1.5, INT) succeeded, want a parse error")
+	}
+}
+
+func TestArchiveReaderReadsS3Run(t *testing.T) {
+	fake, server := newFakeS3(t, "restore-bucket")
+	config := testS3Config(t, server.URL)
+	cs := &CleanupService{config: config}
+
+	var member bytes.Buffer
+	zw := gzip.NewWriter(&member)
+	zw.Write([]byte(`{"id":1}` + "\n"))
+	zw.Close()
+	fake.objects["cleanup/20250101_120000/journal.jsonl.gz"] = member.Bytes()
+
+	readFile, err := cs.archiveReader("s3://restore-bucket/cleanup/20250101_120000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readFile("journal.jsonl.gz")
+	if err != nil {
+		t.Fatalf("reading from S3: %v", err)
+	}
+	if !bytes.Equal(data, member.Bytes()) {
+		t.Error("object read from S3 differs from the stored object")
+	}
+	if _, err := readFile("manifest.json"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("reading a missing object: error = %v, want 404", err)
+	}
+
+	for _, source := range []string{"s3://restore-bucket", "s3:///run"} {
+		if _, err := cs.archiveReader(source); err == nil {
+			t.Errorf("archiveReader(%q) succeeded, want an invalid source error", source)
+		}
+	}
+}
+
+func TestFirstRowsByID(t *testing.T) {
+	columns := []string{"quantity", "id"}
+	got, err := firstRowsByID(columns, [][]any{{"5.000", int64(1)}, {"3.000", int64(2)}, {"2.000", int64(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]any{{"5.000", int64(1)}, {"3.000", int64(2)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("firstRowsByID = %v, want %v", got, want)
+	}
+
+	if _, err := firstRowsByID([]string{"quantity"}, [][]any{{"1.000"}}); err == nil {
+		t.Error("firstRowsByID without an id column succeeded")
+	}
+}
+
+func TestRestoreUpdate(t *testing.T) {
+	query, args := restoreUpdate("form_detail", []string{"quantity", "id", "headerFk"}, []any{"4.000", int64(12), nil})
+	if query != "UPDATE form_detail SET `quantity` = ?, `headerFk` = ? WHERE id = ?" {
+		t.Errorf("restoreUpdate query = %s", query)
+	}
+	if !reflect.DeepEqual(args, []any{"4.000", nil, int64(12)}) {
+		t.Errorf("restoreUpdate args = %v", args)
+	}
+}
+
+// recordingArchiver records the batches passed to Archive
+type recordingArchiver struct {
+	batches [][]int
+}
+
+func (a *recordingArchiver) Archive(tx dbExecutor, tableName string, ids []int) error {
+	a.batches = append(a.batches, ids)
+	return nil
+}
+func (a *recordingArchiver) Flush() error { return nil }
+func (a *recordingArchiver) Close() error { return nil }
+
+func TestArchiveUpdatesInBatches(t *testing.T) {
+	archiver := &recordingArchiver{}
+	cs := &CleanupService{archiver: archiver}
+
+	ids := make([]int, 2500)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	if err := cs.archiveUpdates(nil, "form_detail", ids); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	for _, batch := range archiver.batches {
+		sizes = append(sizes, len(batch))
+	}
+	if !reflect.DeepEqual(sizes, []int{1000, 1000, 500}) || archiver.batches[2][499] != 2500 {
+		t.Errorf("archived batches of %v, want 1000, 1000 and 500 ending with id 2500", sizes)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// groupKey identifies a journal balance group (referenceFk, itemFk, locationFk, shopFk)
+type groupKey struct {
+	ReferenceFk int
+	ItemFk      int
+	LocationFk  int
+	ShopFk      int
+}
+
+func recordGroupKey(record DeletedRecord) groupKey {
+	return groupKey{record.ReferenceFk, record.ItemFk, record.LocationFk, record.ShopFk}
+}
+
+// ApplyRetentionRule removes the latest keepRows journal rows (and rows within the last
+// keepMonths months) per itemFk/shopFk from the records to delete. Within each group
+// only the oldest rows whose running balance returns to zero are kept for deletion, so the
+// retained rows still balance on their own. Returns the records to delete and the number retained.
+func (cs *CleanupService) ApplyRetentionRule(records []DeletedRecord, keepRows, keepMonths int) ([]DeletedRecord, int, error) {
+	if len(records) == 0 || (keepRows <= 0 && keepMonths <= 0) {
+		return records, 0, nil
+	}
+
+	retained, err := cs.findRetainedJournalIDs(records, keepRows, keepMonths)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	groups := make(map[groupKey][]DeletedRecord)
+	var order []groupKey
+	for _, record := range records {
+		key := recordGroupKey(record)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], record)
+	}
+
+	var toDelete []DeletedRecord
+	for _, key := range order {
+		rows := groups[key]
+		sort.SliceStable(rows, func(i, j int) bool {
+			if rows[i].TxnDate != rows[j].TxnDate {
+				return rows[i].TxnDate < rows[j].TxnDate
+			}
+			return rows[i].JournalID < rows[j].JournalID
+		})
+
+		// Retained rows are the newest of each item/shop, so the deletable rows
+		// form a prefix; cut it at the last point where it nets to zero.
+		running := 0.0
+		lastZero := -1
+		for i, row := range rows {
+			if retained[row.JournalID] {
+				break
+			}
+			running += float64(row.Type) * row.Quantity
+			if running > -0.001 && running < 0.001 {
+				lastZero = i
+			}
+		}
+
+		if lastZero < len(rows)-1 {
+			cs.logger.Printf("Retention: referenceFk %d item %d location %d shop %d keeps %d of %d journal records",
+				key.ReferenceFk, key.ItemFk, key.LocationFk, key.ShopFk, len(rows)-lastZero-1, len(rows))
+		}
+		toDelete = append(toDelete, rows[:lastZero+1]...)
+	}
+
+	return toDelete, len(records) - len(toDelete), nil
+}
+
+// findRetainedJournalIDs returns the journal IDs protected by the retention rule
+func (cs *CleanupService) findRetainedJournalIDs(records []DeletedRecord, keepRows, keepMonths int) (map[int]bool, error) {
+	itemSeen := make(map[int]bool)
+	var itemFks []string
+	for _, record := range records {
+		if !itemSeen[record.ItemFk] {
+			itemSeen[record.ItemFk] = true
+			itemFks = append(itemFks, fmt.Sprintf("%d", record.ItemFk))
+		}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT r.id
+		FROM (
+			SELECT 
+				j.id,
+				j.journalDate,
+				ROW_NUMBER() OVER (PARTITION BY j.itemFk, j.shopFk ORDER BY j.journalDate DESC, j.id DESC) as row_num
+			FROM journal j
+			WHERE j.accountFk = 2
+			  AND j.itemFk IN (%s)
+			  AND %s
+		) r
+		WHERE r.row_num <= ?
+		   OR (? > 0 AND r.journalDate > DATE_SUB(CURDATE(), INTERVAL ? MONTH))
+	`, strings.Join(itemFks, ","), cs.notDeleted("j"))
+
+	rows, err := cs.conn().Query(query, keepRows, keepMonths, keepMonths)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retained := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		retained[id] = true
+	}
+
+	return retained, rows.Err()
+}
+
+// RetentionRule is the retention period for one formType
+type RetentionRule struct {
+	Months int
+	Never  bool
+	Label  string
+}
+
+// RetentionPolicy maps form_header.formType to its retention rule
+type RetentionPolicy struct {
+	rules    map[int]RetentionRule
+	fallback *RetentionRule
+}
+
+// ParseRetentionPolicy parses "formType:period" pairs such as "1:10y,2:1y,3:never"
+// plus an optional default period applied to form types not listed
+func ParseRetentionPolicy(spec, fallback string) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{rules: make(map[int]RetentionRule)}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention rule %q (use formType:period)", entry)
+		}
+		formType, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid form type in retention rule %q", entry)
+		}
+		rule, err := parseRetentionPeriod(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rule.Label = fmt.Sprintf("formType %d: %s", formType, rule.Label)
+		policy.rules[formType] = rule
+	}
+
+	if strings.TrimSpace(fallback) != "" {
+		rule, err := parseRetentionPeriod(fallback)
+		if err != nil {
+			return nil, err
+		}
+		rule.Label = "default: " + rule.Label
+		policy.fallback = &rule
+	}
+
+	return policy, nil
+}
+
+// parseRetentionPeriod parses "10y", "18m" or "never"
+func parseRetentionPeriod(period string) (RetentionRule, error) {
+	period = strings.ToLower(strings.TrimSpace(period))
+	if period == "never" {
+		return RetentionRule{Never: true, Label: "never auto-deleted"}, nil
+	}
+	if len(period) < 2 {
+		return RetentionRule{}, fmt.Errorf("invalid retention period %q (use Ny, Nm or never)", period)
+	}
+	n, err := strconv.Atoi(period[:len(period)-1])
+	if err != nil || n < 0 {
+		return RetentionRule{}, fmt.Errorf("invalid retention period %q (use Ny, Nm or never)", period)
+	}
+	switch period[len(period)-1] {
+	case 'y':
+		return RetentionRule{Months: n * 12, Label: "retain " + period}, nil
+	case 'm':
+		return RetentionRule{Months: n, Label: "retain " + period}, nil
+	}
+	return RetentionRule{}, fmt.Errorf("invalid retention period %q (use Ny, Nm or never)", period)
+}
+
+// Enabled reports whether any retention rule is configured
+func (p *RetentionPolicy) Enabled() bool {
+	return p != nil && (len(p.rules) > 0 || p.fallback != nil)
+}
+
+// Check returns whether a document of formType dated formDate may be deleted
+// as of now, with the rule and the justification either way
+func (p *RetentionPolicy) Check(formType int, formDate string, now time.Time) (string, string, bool) {
+	rule, ok := p.rules[formType]
+	if !ok {
+		if p.fallback == nil {
+			return "none", fmt.Sprintf("no retention rule for formType %d", formType), true
+		}
+		rule = *p.fallback
+	}
+
+	if rule.Never {
+		return rule.Label, fmt.Sprintf("formType %d is never auto-deleted", formType), false
+	}
+
+	limit := now.AddDate(0, -rule.Months, 0).Format("2006-01-02")
+	day := dateOnly(formDate)
+	if day == "" || day > limit {
+		return rule.Label, fmt.Sprintf("formDate %s is after retention limit %s", day, limit), false
+	}
+	return rule.Label, fmt.Sprintf("formDate %s is on or before retention limit %s", day, limit), true
+}
+
+// ApplyRetentionPolicy removes balance groups containing documents still under retention
+func (cs *CleanupService) ApplyRetentionPolicy(records []DeletedRecord, policy *RetentionPolicy, now time.Time, step string) ([]DeletedRecord, []SkippedRecord) {
+	if !policy.Enabled() {
+		return records, nil
+	}
+
+	blockedGroups := make(map[groupKey]string)
+	for _, record := range records {
+		key := recordGroupKey(record)
+		if _, done := blockedGroups[key]; done {
+			continue
+		}
+		if rule, justification, allowed := policy.Check(record.FormType, record.FormDate, now); !allowed {
+			blockedGroups[key] = fmt.Sprintf("retention %s, header %d %s (journal %d in same balance group)",
+				rule, record.HeaderID, justification, record.JournalID)
+		}
+	}
+
+	var kept []DeletedRecord
+	var skipped []SkippedRecord
+	for _, record := range records {
+		if reason, blocked := blockedGroups[recordGroupKey(record)]; blocked {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "journal", ID: record.JournalID, Reason: reason})
+			continue
+		}
+		kept = append(kept, record)
+	}
+
+	return kept, skipped
+}
+
+// ComplianceEntries returns the retention rule justifying each journal deletion
+func (p *RetentionPolicy) ComplianceEntries(records []DeletedRecord, now time.Time, step string) []ComplianceEntry {
+	if !p.Enabled() {
+		return nil
+	}
+
+	var entries []ComplianceEntry
+	for _, record := range records {
+		rule, justification, _ := p.Check(record.FormType, record.FormDate, now)
+		entries = append(entries, ComplianceEntry{
+			Step:          step,
+			Table:         "journal",
+			ID:            record.JournalID,
+			HeaderID:      record.HeaderID,
+			FormType:      record.FormType,
+			FormDate:      dateOnly(record.FormDate),
+			Rule:          rule,
+			Justification: justification,
+		})
+	}
+	return entries
+}
+
+// ApplyRetentionPolicyToHeaders removes orphaned headers still under retention
+// and returns the compliance entries justifying each remaining header deletion
+func (cs *CleanupService) ApplyRetentionPolicyToHeaders(headers []OrphanedHeader, policy *RetentionPolicy, now time.Time, step string) ([]OrphanedHeader, []SkippedRecord, []ComplianceEntry) {
+	if !policy.Enabled() {
+		return headers, nil, nil
+	}
+
+	var kept []OrphanedHeader
+	var skipped []SkippedRecord
+	var entries []ComplianceEntry
+	for _, header := range headers {
+		rule, justification, allowed := policy.Check(header.FormType, header.FormDate, now)
+		if !allowed {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "form_header", ID: header.ID,
+				Reason: fmt.Sprintf("retention %s, %s", rule, justification)})
+			continue
+		}
+		entries = append(entries, ComplianceEntry{
+			Step:          step,
+			Table:         "form_header",
+			ID:            header.ID,
+			HeaderID:      header.ID,
+			FormType:      header.FormType,
+			FormDate:      dateOnly(header.FormDate),
+			Rule:          rule,
+			Justification: justification,
+		})
+		kept = append(kept, header)
+	}
+
+	return kept, skipped, entries
+}
+
+// ComplianceReport writes the compliance entries as CSV while the cleanup runs. The entries
+// of each step are flushed as soon as the step completes, so deletions committed before a later
+// failure are still on record. The status column tells whether the deletions were committed.
+type ComplianceReport struct {
+	file   *os.File
+	writer *csv.Writer
+	status string
+	count  int
+}
+
+// CreateComplianceReport creates the CSV file and writes the header row
+func CreateComplianceReport(filename, status string) (*ComplianceReport, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ComplianceReport{file: file, writer: csv.NewWriter(file), status: status}
+	report.writer.Write([]string{"step", "table", "id", "header_id", "form_type", "form_date", "rule", "justification", "status"})
+	report.writer.Flush()
+	if err := report.writer.Error(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return report, nil
+}
+
+// Write appends the entries of a completed step. A nil report ignores them.
+func (r *ComplianceReport) Write(entries []ComplianceEntry) error {
+	if r == nil {
+		return nil
+	}
+
+	for _, entry := range entries {
+		r.writer.Write([]string{
+			entry.Step,
+			entry.Table,
+			strconv.Itoa(entry.ID),
+			strconv.Itoa(entry.HeaderID),
+			strconv.Itoa(entry.FormType),
+			entry.FormDate,
+			entry.Rule,
+			entry.Justification,
+			r.status,
+		})
+	}
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		return err
+	}
+
+	r.count += len(entries)
+	return r.file.Sync()
+}
+
+// Close closes the CSV file
+func (r *ComplianceReport) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
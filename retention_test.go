@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := ParseRetentionPolicy(" 1:10y, 2:18M ,3:never,", "7y")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]RetentionRule{
+		1: {Months: 120, Label: "formType 1: retain 10y"},
+		2: {Months: 18, Label: "formType 2: retain 18m"},
+		3: {Never: true, Label: "formType 3: never auto-deleted"},
+	}
+	if len(policy.rules) != len(want) {
+		t.Errorf("parsed %d rules, want %d", len(policy.rules), len(want))
+	}
+	for formType, rule := range want {
+		if policy.rules[formType] != rule {
+			t.Errorf("rule for formType %d = %+v, want %+v", formType, policy.rules[formType], rule)
+		}
+	}
+	if policy.fallback == nil || *policy.fallback != (RetentionRule{Months: 84, Label: "default: retain 7y"}) {
+		t.Errorf("fallback = %+v, want 84 months", policy.fallback)
+	}
+	if !policy.Enabled() {
+		t.Error("policy with rules is not enabled")
+	}
+
+	empty, err := ParseRetentionPolicy("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Enabled() {
+		t.Error("empty policy is enabled")
+	}
+}
+
+func TestParseRetentionPolicyErrors(t *testing.T) {
+	for _, tt := range []struct {
+		spec     string
+		fallback string
+		wantErr  string
+	}{
+		{"1", "", "use formType:period"},
+		{"x:1y", "", "invalid form type"},
+		{"1:10", "", "invalid retention period"},
+		{"1:-1y", "", "invalid retention period"},
+		{"1:5d", "", "invalid retention period"},
+		{"1:y", "", "invalid retention period"},
+		{"", "forever", "invalid retention period"},
+	} {
+		_, err := ParseRetentionPolicy(tt.spec, tt.fallback)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseRetentionPolicy(%q, %q) error = %v, want %q", tt.spec, tt.fallback, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRetentionPolicyCheck(t *testing.T) {
+	now := time.Date(2025, time.March, 15, 0, 0, 0, 0, time.UTC)
+	policy, err := ParseRetentionPolicy("1:10y,3:never", "1y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutFallback, err := ParseRetentionPolicy("1:10y", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		policy    *RetentionPolicy
+		formType  int
+		formDate  string
+		wantRule  string
+		wantAllow bool
+	}{
+		{"older than the period", policy, 1, "2015-03-01 08:00:00", "formType 1: retain 10y", true},
+		{"on the retention limit", policy, 1, "2015-03-15", "formType 1: retain 10y", true},
+		{"within the period", policy, 1, "2015-03-16", "formType 1: retain 10y", false},
+		{"never deleted", policy, 3, "1990-01-01", "formType 3: never auto-deleted", false},
+		{"fallback rule", policy, 9, "2024-03-15", "default: retain 1y", true},
+		{"fallback rule within the period", policy, 9, "2024-06-01", "default: retain 1y", false},
+		{"missing form date", policy, 1, "", "formType 1: retain 10y", false},
+		{"no rule and no fallback", withoutFallback, 9, "2025-03-01", "none", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, reason, allowed := tt.policy.Check(tt.formType, tt.formDate, now)
+			if rule != tt.wantRule || allowed != tt.wantAllow {
+				t.Errorf("Check = %q, %v (%s), want %q, %v", rule, allowed, reason, tt.wantRule, tt.wantAllow)
+			}
+		})
+	}
+}
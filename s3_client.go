@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal S3-compatible client (path-style URLs, AWS Signature V4),
+// enough to upload archive files with multipart upload and read them back.
+// The archiver needs only PutObject, GetObject and the three multipart calls, so this is
+// written against the standard library rather than pulling minio-go or aws-sdk-go-v2 and
+// their dependency trees into a module that otherwise only depends on the MySQL driver.
+//
+// Every request with a body carries Content-MD5, so the server rejects a corrupted upload,
+// and the ETag of a PUT or part, the MD5 of its body on S3 and MinIO, is compared as well.
+// Buckets with SSE-KMS or SSE-C return other ETags and are not supported; use ARCHIVE_KEY.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+func newS3Client(config *Config) (*s3Client, error) {
+	endpoint, err := url.Parse(config.S3Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q (use http://host:port or https://host)", config.S3Endpoint)
+	}
+
+	return &s3Client{
+		endpoint:  endpoint,
+		region:    config.S3Region,
+		bucket:    config.S3Bucket,
+		accessKey: config.S3AccessKey,
+		secretKey: config.S3SecretKey,
+		http:      &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// PutObject uploads a small object in a single request and checks its ETag
+func (c *s3Client) PutObject(key string, body []byte) error {
+	resp, err := c.do(http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return checkETag(resp, body)
+}
+
+// UploadMultipart uploads the content of r with multipart upload in parts of partSize bytes
+// and returns its SHA-256. The upload is aborted when a part or the completion fails.
+func (c *s3Client) UploadMultipart(key string, r io.Reader, partSize int64) (string, error) {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", fmt.Errorf("starting multipart upload of %s: %v", key, err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("starting multipart upload of %s: %v", key, err)
+	}
+
+	hash := sha256.New()
+	err = c.uploadParts(key, initiated.UploadID, io.TeeReader(r, hash), partSize)
+	if err != nil {
+		abort, abortErr := c.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil)
+		if abortErr == nil {
+			abort.Body.Close()
+		}
+		return "", fmt.Errorf("uploading %s: %v", key, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// completedPart is a part entry of CompleteMultipartUpload
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *s3Client) uploadParts(key, uploadID string, file io.Reader, partSize int64) error {
+	var parts []completedPart
+	buffer := make([]byte, partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(file, buffer)
+		if err == io.EOF && number > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		query := url.Values{"partNumber": {fmt.Sprintf("%d", number)}, "uploadId": {uploadID}}
+		resp, err := c.do(http.MethodPut, key, query, buffer[:n])
+		if err != nil {
+			return fmt.Errorf("part %d: %v", number, err)
+		}
+		resp.Body.Close()
+		if err := checkETag(resp, buffer[:n]); err != nil {
+			return fmt.Errorf("part %d: %v", number, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if int64(n) < partSize {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return fmt.Errorf("completing upload: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// CompleteMultipartUpload can report an error with status 200
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		return fmt.Errorf("completing upload: %s", result)
+	}
+	return nil
+}
+
+// GetObject downloads an object
+func (c *s3Client) GetObject(key string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// checkETag compares the ETag of an uploaded object or part with the MD5 of the body sent
+func checkETag(resp *http.Response, body []byte) error {
+	sum := md5.Sum(body)
+	expected := hex.EncodeToString(sum[:])
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if etag != expected {
+		return fmt.Errorf("ETag %q does not match the MD5 %s of the uploaded data", etag, expected)
+	}
+	return nil
+}
+
+// do sends a signed request and returns the response when the status is 2xx
+func (c *s3Client) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s3Escape(c.bucket) + "/" + s3Escape(key)
+	target := c.endpoint.Scheme + "://" + c.endpoint.Host + path
+	if len(query) > 0 {
+		target += "?" + canonicalQuery(query)
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	c.sign(req, path, query, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to the request
+func (c *s3Client) sign(req *http.Request, path string, query url.Values, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		req.URL.Host, payloadHash, amzDate)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, canonicalQuery(query), canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query parameters sorted by name, as required for signing
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters and '/'
+func s3Escape(s string) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// sqlSession runs all cleanup steps in one outer transaction that is rolled back at the end,
+// so every step sees the changes of the previous ones without anything being committed.
+// The Commit and Rollback calls of the steps are no-ops. With a recorder, every executed
+// statement is collected together with the statements that undo it.
+type sqlSession struct {
+	tx       *sql.Tx
+	recorder *sqlRecorder
+	archiver Archiver
+	changes  map[string]int64
+	order    []string
+}
+
+func (s *sqlSession) Exec(query string, args ...any) (sql.Result, error) {
+	if s.recorder != nil {
+		err := s.recorder.before(s.tx, query, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := s.tx.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, _ := result.RowsAffected()
+	s.count(query, affected)
+	if s.recorder != nil {
+		s.recorder.record(query, args, affected)
+	}
+	return result, nil
+}
+
+// count adds the affected rows of a statement to its table and operation
+func (s *sqlSession) count(query string, affected int64) {
+	key := "other statements"
+	if m := mutationPattern.FindStringSubmatch(query); m != nil {
+		operation := "updated"
+		if strings.HasPrefix(strings.ToUpper(m[1]), "DELETE") {
+			operation = "deleted"
+		}
+		key = m[2] + " " + operation
+	}
+
+	if _, ok := s.changes[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.changes[key] += affected
+}
+
+func (s *sqlSession) Query(query string, args ...any) (*sql.Rows, error) {
+	return s.tx.Query(query, args...)
+}
+
+func (s *sqlSession) QueryRow(query string, args ...any) *sql.Row {
+	return s.tx.QueryRow(query, args...)
+}
+
+func (s *sqlSession) Commit() error   { return nil }
+func (s *sqlSession) Rollback() error { return nil }
+
+// conn returns the connection for queries, the open session when there is one
+func (cs *CleanupService) conn() dbExecutor {
+	if cs.session != nil {
+		return cs.session
+	}
+	return cs.db
+}
+
+// begin starts a transaction for a step, or joins the open session
+func (cs *CleanupService) begin() (dbTx, error) {
+	if cs.session != nil {
+		return cs.session, nil
+	}
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// StartSession opens the outer transaction for the following steps. Archiving is
+// disabled while it is open, since none of the deletions are committed.
+// With record set, the executed statements are collected for EmitSQL.
+func (cs *CleanupService) StartSession(record bool) error {
+	if cs.session != nil {
+		return fmt.Errorf("a session is already open")
+	}
+
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	cs.session = &sqlSession{tx: tx, archiver: cs.archiver, changes: make(map[string]int64)}
+	if record {
+		cs.session.recorder = &sqlRecorder{}
+	}
+	cs.archiver = noArchiver{}
+	return nil
+}
+
+// ShowSessionChanges displays the rows affected in the open session per table and operation
+func (cs *CleanupService) ShowSessionChanges() {
+	if cs.session == nil {
+		return
+	}
+
+	fmt.Println("\nRows affected before rollback:")
+	fmt.Printf("%-30s %-10s\n", "Table", "Rows")
+	fmt.Println(strings.Repeat("-", 41))
+	for _, key := range cs.session.order {
+		fmt.Printf("%-30s %-10d\n", key, cs.session.changes[key])
+		cs.logger.Printf("Simulated %s: %d rows", key, cs.session.changes[key])
+	}
+	if len(cs.session.order) == 0 {
+		fmt.Println("(no changes)")
+	}
+}
+
+// EndSession rolls back the outer transaction and restores the archiver
+func (cs *CleanupService) EndSession() error {
+	if cs.session == nil {
+		return nil
+	}
+
+	err := cs.session.tx.Rollback()
+	cs.archiver = cs.session.archiver
+	cs.session = nil
+	return err
+}
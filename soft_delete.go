@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+)
+
+// purgeTables lists the soft-deleted tables in the order they are purged, children first
+var purgeTables = []string{"journal", "form_detail", "form_header"}
+
+// notDeleted returns a condition that hides soft-deleted rows of the given table alias.
+// It is always true when soft delete is disabled.
+func (cs *CleanupService) notDeleted(alias string) string {
+	if !cs.config.SoftDelete {
+		return "1 = 1"
+	}
+	column := "`" + cs.config.SoftDeleteColumn + "`"
+	if alias != "" {
+		column = alias + "." + column
+	}
+	return column + " IS NULL"
+}
+
+// softDeleteQuery builds the UPDATE that marks a batch of rows as deleted by this run
+func (cs *CleanupService) softDeleteQuery(tableName, inClause string) (string, []any) {
+	set := fmt.Sprintf("`%s` = NOW()", cs.config.SoftDeleteColumn)
+	var args []any
+	if cs.config.SoftDeleteFlagColumn != "" {
+		set += fmt.Sprintf(", `%s` = 1", cs.config.SoftDeleteFlagColumn)
+	}
+	if cs.config.SoftDeleteRunColumn != "" {
+		set += fmt.Sprintf(", `%s` = ?", cs.config.SoftDeleteRunColumn)
+		args = append(args, cs.config.RunID)
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id IN (%s) AND %s",
+		tableName, set, inClause, cs.notDeleted(""))
+	return query, args
+}
+
+// CountPurgeable returns, per table, the number of rows soft-deleted more than days ago
+func (cs *CleanupService) CountPurgeable(days int) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, table := range purgeTables {
+		var count int
+		err := cs.db.QueryRow(fmt.Sprintf(
+			"SELECT COUNT(*) FROM %s WHERE `%s` < DATE_SUB(NOW(), INTERVAL ? DAY)",
+			table, cs.config.SoftDeleteColumn), days).Scan(&count)
+		if err != nil {
+			return nil, fmt.Errorf("counting soft-deleted %s rows: %v", table, err)
+		}
+		counts[table] = count
+	}
+	return counts, nil
+}
+
+// PurgeSoftDeleted archives and hard-deletes rows soft-deleted more than days ago in one transaction
+func (cs *CleanupService) PurgeSoftDeleted(days int) (map[string]int, error) {
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	purged := make(map[string]int)
+	for _, table := range purgeTables {
+		ids, err := cs.findPurgeableIDs(tx, table, days)
+		if err != nil {
+			return nil, err
+		}
+
+		batchSize := 1000
+		for i := 0; i < len(ids); i += batchSize {
+			end := i + batchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+
+			batch := ids[i:end]
+			err = cs.archiver.Archive(tx, table, batch)
+			if err != nil {
+				cs.logger.Printf("Error archiving %s before purge: %v", table, err)
+				return nil, err
+			}
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", table, joinIDs(batch)))
+			if err != nil {
+				cs.logger.Printf("Error purging %s: %v", table, err)
+				return nil, err
+			}
+		}
+
+		purged[table] = len(ids)
+		cs.logger.Printf("Purged %d soft-deleted %s rows: %v", len(ids), table, ids)
+	}
+
+	err = cs.commit(tx)
+	if err != nil {
+		cs.logger.Printf("Error committing purge: %v", err)
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// findPurgeableIDs returns the ids of rows soft-deleted more than days ago
+func (cs *CleanupService) findPurgeableIDs(q dbExecutor, table string, days int) ([]int, error) {
+	rows, err := q.Query(fmt.Sprintf(
+		"SELECT id FROM %s WHERE `%s` < DATE_SUB(NOW(), INTERVAL ? DAY) ORDER BY id",
+		table, cs.config.SoftDeleteColumn), days)
+	if err != nil {
+		return nil, fmt.Errorf("finding soft-deleted %s rows: %v", table, err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// transferRow is one side of a location transfer
+type transferRow struct {
+	JournalID  int
+	LocationFk int
+	Type       int
+}
+
+// ExcludeUnpairedTransfers keeps location transfers atomic. A transfer is a form_detail with
+// journal rows of opposite types at different locations; its rows may only be deleted when
+// every side is being deleted. Groups holding a blocked side are skipped as a whole so the
+// remaining deletions still balance, which can in turn block other transfers.
+func (cs *CleanupService) ExcludeUnpairedTransfers(records []DeletedRecord, step string) ([]DeletedRecord, []SkippedRecord, []BlockedTransfer, error) {
+	if len(records) == 0 {
+		return records, nil, nil, nil
+	}
+
+	transfers, err := cs.findTransferRows(records)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(transfers) == 0 {
+		return records, nil, nil, nil
+	}
+
+	candidates := make(map[int]bool)
+	for _, record := range records {
+		candidates[record.JournalID] = true
+	}
+
+	blockedGroups := make(map[groupKey]string)
+	var blocked []BlockedTransfer
+	blockedDetails := make(map[int]bool)
+	for changed := true; changed; {
+		changed = false
+		for detailID, rows := range transfers {
+			var inside, outside []transferRow
+			for _, row := range rows {
+				if candidates[row.JournalID] {
+					inside = append(inside, row)
+				} else {
+					outside = append(outside, row)
+				}
+			}
+			if len(inside) == 0 || len(outside) == 0 {
+				continue
+			}
+			if !blockedDetails[detailID] {
+				blockedDetails[detailID] = true
+				blocked = append(blocked, BlockedTransfer{
+					DetailID:             detailID,
+					JournalID:            inside[0].JournalID,
+					LocationFk:           inside[0].LocationFk,
+					CounterpartJournalID: outside[0].JournalID,
+					CounterpartLocation:  outside[0].LocationFk,
+				})
+			}
+
+			reason := fmt.Sprintf("transfer detail %d: counterpart journal %d at location %d is not being cleaned",
+				detailID, outside[0].JournalID, outside[0].LocationFk)
+			for _, record := range records {
+				if record.DetailID != detailID || !candidates[record.JournalID] {
+					continue
+				}
+				key := recordGroupKey(record)
+				if _, done := blockedGroups[key]; !done {
+					blockedGroups[key] = reason
+				}
+			}
+			for _, record := range records {
+				if _, blocked := blockedGroups[recordGroupKey(record)]; blocked && candidates[record.JournalID] {
+					candidates[record.JournalID] = false
+					changed = true
+				}
+			}
+		}
+	}
+
+	var kept []DeletedRecord
+	var skipped []SkippedRecord
+	for _, record := range records {
+		if reason, blocked := blockedGroups[recordGroupKey(record)]; blocked {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "journal", ID: record.JournalID, Reason: reason})
+			continue
+		}
+		kept = append(kept, record)
+	}
+
+	sort.Slice(blocked, func(i, j int) bool { return blocked[i].DetailID < blocked[j].DetailID })
+	return kept, skipped, blocked, nil
+}
+
+// ExcludeUnpairedFIFOReductions keeps location transfers atomic under FIFO matching. A transfer
+// row FIFO would only reduce no longer matches its counterpart, so its group is skipped first;
+// the remaining reductions must then pass ExcludeUnpairedTransfers like the other steps.
+func (cs *CleanupService) ExcludeUnpairedFIFOReductions(reductions []JournalReduction, step string) ([]JournalReduction, []SkippedRecord, []BlockedTransfer, error) {
+	if len(reductions) == 0 {
+		return reductions, nil, nil, nil
+	}
+
+	var records []DeletedRecord
+	for _, reduction := range reductions {
+		records = append(records, reduction.Record)
+	}
+	transfers, err := cs.findTransferRows(records)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(transfers) == 0 {
+		return reductions, nil, nil, nil
+	}
+
+	transferDetail := make(map[int]int)
+	for detailID, rows := range transfers {
+		for _, row := range rows {
+			transferDetail[row.JournalID] = detailID
+		}
+	}
+
+	blockedGroups := make(map[groupKey]string)
+	for _, reduction := range reductions {
+		detailID, ok := transferDetail[reduction.Record.JournalID]
+		if !ok || reduction.Delete {
+			continue
+		}
+		key := recordGroupKey(reduction.Record)
+		if _, done := blockedGroups[key]; !done {
+			blockedGroups[key] = fmt.Sprintf("transfer detail %d: journal %d would only be reduced",
+				detailID, reduction.Record.JournalID)
+		}
+	}
+
+	var candidates []DeletedRecord
+	var skipped []SkippedRecord
+	for _, record := range records {
+		if reason, blocked := blockedGroups[recordGroupKey(record)]; blocked {
+			skipped = append(skipped, SkippedRecord{Step: step, Table: "journal", ID: record.JournalID, Reason: reason})
+			continue
+		}
+		candidates = append(candidates, record)
+	}
+
+	kept, pairSkipped, blocked, err := cs.ExcludeUnpairedTransfers(candidates, step)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	keptIDs := make(map[int]bool)
+	for _, record := range kept {
+		keptIDs[record.JournalID] = true
+	}
+	var result []JournalReduction
+	for _, reduction := range reductions {
+		if keptIDs[reduction.Record.JournalID] {
+			result = append(result, reduction)
+		}
+	}
+
+	return result, append(skipped, pairSkipped...), blocked, nil
+}
+
+// findTransferRows returns all inventory journal rows of the transfer details among the records
+func (cs *CleanupService) findTransferRows(records []DeletedRecord) (map[int][]transferRow, error) {
+	detailSeen := make(map[int]bool)
+	var detailIDs []string
+	for _, record := range records {
+		if !detailSeen[record.DetailID] {
+			detailSeen[record.DetailID] = true
+			detailIDs = append(detailIDs, fmt.Sprintf("%d", record.DetailID))
+		}
+	}
+
+	transfers := make(map[int][]transferRow)
+	batchSize := 1000
+	for i := 0; i < len(detailIDs); i += batchSize {
+		end := i + batchSize
+		if end > len(detailIDs) {
+			end = len(detailIDs)
+		}
+
+		query := fmt.Sprintf(`
+			SELECT j.detailFk, j.id, j.locationFk, j.type
+			FROM journal j
+			WHERE j.accountFk = 2
+			  AND %s
+			  AND j.detailFk IN (
+				SELECT detailFk
+				FROM journal
+				WHERE accountFk = 2
+				  AND detailFk IN (%s)
+				  AND %s
+				GROUP BY detailFk
+				HAVING COUNT(DISTINCT locationFk) > 1
+				   AND MIN(type) < 0
+				   AND MAX(type) > 0
+			  )
+			ORDER BY j.detailFk, j.id
+		`, cs.notDeleted("j"), strings.Join(detailIDs[i:end], ","), cs.notDeleted(""))
+
+		rows, err := cs.conn().Query(query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var detailID int
+			var row transferRow
+			if err := rows.Scan(&detailID, &row.JournalID, &row.LocationFk, &row.Type); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			transfers[detailID] = append(transfers[detailID], row)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return transfers, nil
+}
+
+// ShowBlockedTransfers displays the transfers kept because only one side qualified
+func ShowBlockedTransfers(transfers []BlockedTransfer, names *NameLookups) {
+	if len(transfers) == 0 {
+		return
+	}
+
+	fmt.Printf("\nTransfers blocked because only one side qualifies (%d):\n", len(transfers))
+	locationWidth := names.Width("location", 14)
+	fmt.Printf("%-10s %-10s %-*s %-14s %-*s\n", "DetailID", "JournalID", locationWidth, "Location",
+		"OtherJournal", locationWidth, "OtherLocation")
+	fmt.Println(strings.Repeat("-", 38+2*locationWidth))
+
+	count := 0
+	for _, transfer := range transfers {
+		if count >= 20 {
+			fmt.Printf("... and %d more records\n", len(transfers)-20)
+			break
+		}
+		fmt.Printf("%-10d %-10d %-*s %-14d %-*s\n",
+			transfer.DetailID, transfer.JournalID, locationWidth, names.Label("location", transfer.LocationFk),
+			transfer.CounterpartJournalID, locationWidth, names.Label("location", transfer.CounterpartLocation))
+		count++
+	}
+}
+
+// LogBlockedTransfers logs every transfer kept because only one side qualified
+func LogBlockedTransfers(logger *log.Logger, transfers []BlockedTransfer) {
+	for _, transfer := range transfers {
+		logger.Printf("Transfer detail %d blocked: journal %d at location %d qualifies, journal %d at location %d does not",
+			transfer.DetailID, transfer.JournalID, transfer.LocationFk,
+			transfer.CounterpartJournalID, transfer.CounterpartLocation)
+	}
+}
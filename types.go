@@ -10,14 +10,24 @@ type ItemBalance struct {
 	TotalSales     float64
 	NetBalance     float64
 	LastTxnDate    string
+	TxnCount       int
 }
 
 // DeletedRecord represents a record that will be deleted
 type DeletedRecord struct {
-	JournalID int
-	DetailID  int
-	HeaderID  int
-	TxnDate   string
+	JournalID   int
+	DetailID    int
+	HeaderID    int
+	TxnDate     string
+	ReferenceFk int
+	ItemFk      int
+	LocationFk  int
+	ShopFk      int
+	Type        int
+	Quantity    float64
+	PartnerFk   int
+	FormType    int
+	FormDate    string
 }
 
 // Stats represents statistics about records to be processed
@@ -34,4 +44,223 @@ type OrphanedHeader struct {
 	FormDate  string
 	PartnerFk int
 	FormType  int
+	ItemFks   []int // items of its former details' journal rows, for legal holds
+}
+
+// ZeroQuantityDetail represents a form_detail with zero quantity
+type ZeroQuantityDetail struct {
+	ID        int
+	HeaderID  int
+	PartnerFk int
+	ItemFk    int // from its journal rows, 0 without any
+	FormDate  string
+}
+
+// LegalHold represents a legal_hold entry that must never be deleted
+type LegalHold struct {
+	HoldType string // header, partner, item or dates
+	RefID    int
+	DateFrom string
+	DateTo   string
+	Reason   string
+}
+
+// SkippedRecord represents a record excluded from cleanup and why
+type SkippedRecord struct {
+	Step   string
+	Table  string
+	ID     int
+	Reason string
+}
+
+// ComplianceEntry records which retention rule justified a deletion
+type ComplianceEntry struct {
+	Step          string
+	Table         string
+	ID            int
+	HeaderID      int
+	FormType      int
+	FormDate      string
+	Rule          string
+	Justification string
+}
+
+// JournalReduction represents quantity removed from a journal row by FIFO matching
+type JournalReduction struct {
+	Record      DeletedRecord
+	Removed     float64
+	NewQuantity float64
+	Delete      bool
+}
+
+// AuditFinding represents a single integrity problem found by the audit
+type AuditFinding struct {
+	Check   string `json:"check"`
+	Table   string `json:"table"`
+	ID      int    `json:"id"`
+	Details string `json:"details"`
+}
+
+// AuditReport represents the result of an integrity audit
+type AuditReport struct {
+	GeneratedAt string         `json:"generatedAt"`
+	Counts      map[string]int `json:"counts"`
+	Findings    []AuditFinding `json:"findings"`
+}
+
+// QuantityRepair represents a form_detail quantity re-derived from the journal
+type QuantityRepair struct {
+	DetailID    int
+	HeaderID    int
+	OldQuantity float64
+	NewQuantity float64
+}
+
+// OrphanedJournal represents a journal row without a valid form_detail reference.
+// HeaderID and PartnerFk are resolved through the form_detail row when it still exists.
+type OrphanedJournal struct {
+	ID          int
+	AccountFk   int
+	DetailFk    int
+	HeaderID    int
+	PartnerFk   int
+	ReferenceFk int
+	ItemFk      int
+	LocationFk  int
+	ShopFk      int
+	Type        int
+	Quantity    float64
+	JournalDate string
+	Reason      string
+}
+
+// DetailReduction represents the planned quantity change of a form_detail
+type DetailReduction struct {
+	DetailID    int
+	HeaderID    int
+	ShopFk      int
+	OldQuantity float64
+	ReducedBy   float64
+	NewQuantity float64
+	Delete      bool
+}
+
+// HeaderCleanup represents how a form_header is affected by the zero-balance cleanup
+type HeaderCleanup struct {
+	HeaderID         int
+	TotalDetails     int
+	DeletedDetails   int
+	ReducedDetails   int
+	UntouchedDetails int
+}
+
+// BlockedTransfer represents a location transfer kept because only one side qualified
+type BlockedTransfer struct {
+	DetailID             int
+	JournalID            int
+	LocationFk           int
+	CounterpartJournalID int
+	CounterpartLocation  int
+}
+
+// ArchiveManifest describes the files written by one run of the file archive
+type ArchiveManifest struct {
+	RunID          string        `json:"runId"`
+	Format         string        `json:"format"`
+	Encryption     string        `json:"encryption,omitempty"`
+	KeyFingerprint string        `json:"keyFingerprint,omitempty"`
+	UpdatedAt      string        `json:"updatedAt"`
+	Files          []ArchiveFile `json:"files"`
+}
+
+// ArchiveFile is the manifest entry of one table's archive file
+type ArchiveFile struct {
+	Table   string   `json:"table"`
+	File    string   `json:"file"`
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+	Bytes   int64    `json:"bytes"`
+	SHA256  string   `json:"sha256"`
+	// Parts lists the objects an s3 archive file was uploaded as, one per flush, in order
+	Parts []ArchivePart `json:"parts,omitempty"`
+}
+
+// ArchivePart is one uploaded object holding the bytes appended to an archive file between two flushes
+type ArchivePart struct {
+	File   string `json:"file"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// RestoreTable holds the rows of one archive file read back for restoring
+type RestoreTable struct {
+	Table   string
+	Columns []string
+	Rows    [][]any
+}
+
+// CleanupReport holds the complete candidate lists of a cleanup run for the report writers
+type CleanupReport struct {
+	RunID             string
+	Cutoff            string
+	DryRun            bool
+	GeneratedAt       string
+	ZeroBalanceGroups []ItemBalance
+	JournalRows       []DeletedRecord
+	FIFOReductions    []JournalReduction
+	DetailReductions  []DetailReduction
+	OrphanedHeaders   []OrphanedHeader
+	RemainingBalances []ItemBalance
+}
+
+// BalanceFilter restricts a stock balance listing, empty lists match everything
+type BalanceFilter struct {
+	Shops        []int
+	Locations    []int
+	Items        []int
+	NegativeOnly bool
+}
+
+// BalanceTotal sums the balance groups of one shop, or of one location of a shop
+type BalanceTotal struct {
+	ShopFk          int
+	LocationFk      int
+	Groups          int
+	NegativeGroups  int
+	PositiveBalance float64
+	NegativeBalance float64
+	NetBalance      float64
+}
+
+// BalanceReport holds a stock balance listing for the report writers
+type BalanceReport struct {
+	RunID       string
+	GeneratedAt string
+	AsOf        string
+	Filter      BalanceFilter
+	Balances    []ItemBalance
+}
+
+// AgedStock is a group with positive balance and the days since its last movement
+type AgedStock struct {
+	ItemBalance
+	AgeDays int
+	Bucket  string
+}
+
+// AgingTotal sums the aged stock of one location of a shop per age bucket
+type AgingTotal struct {
+	ShopFk     int
+	LocationFk int
+	Groups     []int
+	Quantity   []float64
+}
+
+// AgingReport holds an aged stock listing for the report writers
+type AgingReport struct {
+	RunID       string
+	GeneratedAt string
+	MinDays     int
+	Filter      BalanceFilter
+	Stock       []AgedStock
 }
@@ -2,9 +2,21 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"regexp"
 	"strings"
 )
 
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// quoteIdentifier validates a configured table or column name and quotes it for use in SQL
+func quoteIdentifier(name string) (string, error) {
+	if !identifierPattern.MatchString(name) {
+		return "", fmt.Errorf("invalid SQL identifier %q", name)
+	}
+	return "`" + strings.ReplaceAll(name, ".", "`.`") + "`", nil
+}
+
 // CalculateStats calculates statistics from records to be deleted
 func CalculateStats(records []DeletedRecord) *Stats {
 	detailIDs := make(map[int]bool)
@@ -23,10 +35,14 @@ func CalculateStats(records []DeletedRecord) *Stats {
 }
 
 // ShowDryRunResults displays what would be deleted in dry run mode
-func ShowDryRunResults(records []DeletedRecord) {
+func ShowDryRunResults(records []DeletedRecord, names *NameLookups) {
+	itemWidth := names.Width("item", 10)
+	shopWidth := names.Width("shop", 8)
+
 	fmt.Println("\nDry Run Results - Records that would be deleted:")
-	fmt.Printf("%-10s %-10s %-10s %-12s\n", "JournalID", "DetailID", "HeaderID", "TxnDate")
-	fmt.Println(strings.Repeat("-", 50))
+	fmt.Printf("%-10s %-10s %-10s %-12s %-*s %-*s\n", "JournalID", "DetailID", "HeaderID", "TxnDate",
+		itemWidth, "Item", shopWidth, "Shop")
+	fmt.Println(strings.Repeat("-", 46+itemWidth+shopWidth))
 
 	count := 0
 	for _, record := range records {
@@ -34,17 +50,40 @@ func ShowDryRunResults(records []DeletedRecord) {
 			fmt.Printf("... and %d more records\n", len(records)-20)
 			break
 		}
-		fmt.Printf("%-10d %-10d %-10d %-12s\n",
-			record.JournalID, record.DetailID, record.HeaderID, record.TxnDate)
+		fmt.Printf("%-10d %-10d %-10d %-12s %-*s %-*s\n",
+			record.JournalID, record.DetailID, record.HeaderID, record.TxnDate,
+			itemWidth, names.Label("item", record.ItemFk), shopWidth, names.Label("shop", record.ShopFk))
+		count++
+	}
+}
+
+// ShowZeroQuantityDetails displays zero-quantity form_detail records that would be deleted
+func ShowZeroQuantityDetails(details []ZeroQuantityDetail, names *NameLookups) {
+	partnerWidth := names.Width("partner", 10)
+
+	fmt.Println("\nZero-quantity form_detail that would be deleted:")
+	fmt.Printf("%-10s %-10s %-*s %-12s\n", "DetailID", "HeaderID", partnerWidth, "Partner", "FormDate")
+	fmt.Println(strings.Repeat("-", 40+partnerWidth))
+
+	count := 0
+	for _, detail := range details {
+		if count >= 20 {
+			fmt.Printf("... and %d more records\n", len(details)-20)
+			break
+		}
+		fmt.Printf("%-10d %-10d %-*s %-12s\n",
+			detail.ID, detail.HeaderID, partnerWidth, names.Label("partner", detail.PartnerFk), dateOnly(detail.FormDate))
 		count++
 	}
 }
 
 // ShowOrphanedHeaders displays orphaned headers that would be deleted
-func ShowOrphanedHeaders(headers []OrphanedHeader) {
+func ShowOrphanedHeaders(headers []OrphanedHeader, names *NameLookups) {
+	partnerWidth := names.Width("partner", 10)
+
 	fmt.Println("\nOrphaned headers that would be deleted:")
-	fmt.Printf("%-10s %-20s %-12s %-10s %-10s\n", "ID", "HeaderNo", "FormDate", "PartnerFk", "FormType")
-	fmt.Println(strings.Repeat("-", 72))
+	fmt.Printf("%-10s %-20s %-12s %-*s %-10s\n", "ID", "HeaderNo", "FormDate", partnerWidth, "Partner", "FormType")
+	fmt.Println(strings.Repeat("-", 62+partnerWidth))
 
 	count := 0
 	for _, header := range headers {
@@ -52,8 +91,39 @@ func ShowOrphanedHeaders(headers []OrphanedHeader) {
 			fmt.Printf("... and %d more records\n", len(headers)-20)
 			break
 		}
-		fmt.Printf("%-10d %-20s %-12s %-10d %-10d\n",
-			header.ID, header.HeaderNo, header.FormDate, header.PartnerFk, header.FormType)
+		fmt.Printf("%-10d %-20s %-12s %-*s %-10d\n",
+			header.ID, header.HeaderNo, header.FormDate, partnerWidth, names.Label("partner", header.PartnerFk), header.FormType)
 		count++
 	}
 }
+
+// ShowSkippedRecords lists records excluded from cleanup and the reason
+func ShowSkippedRecords(skipped []SkippedRecord) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	fmt.Printf("\nSkipped %d records:\n", len(skipped))
+	fmt.Printf("%-14s %-12s %-10s %s\n", "Step", "Table", "ID", "Reason")
+	fmt.Println(strings.Repeat("-", 80))
+
+	for _, record := range skipped {
+		fmt.Printf("%-14s %-12s %-10d %s\n", record.Step, record.Table, record.ID, record.Reason)
+	}
+}
+
+// ReportSkippedRecords logs every skipped record and lists them on stdout in dry run mode
+func ReportSkippedRecords(logger *log.Logger, skipped []SkippedRecord, dryRun bool) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	fmt.Printf("Excluded %d records from cleanup\n", len(skipped))
+	for _, record := range skipped {
+		logger.Printf("Skipped %s ID %d (%s): %s", record.Table, record.ID, record.Step, record.Reason)
+	}
+
+	if dryRun {
+		ShowSkippedRecords(skipped)
+	}
+}
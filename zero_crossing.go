@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// FindZeroCrossingRecords returns, for every group with non-zero balance at the cutoff,
+// the journal rows up to and including the latest pre-cutoff point where the running
+// balance (ordered by journalDate, id) was zero. These rows net to zero per group.
+func (cs *CleanupService) FindZeroCrossingRecords(cutoffDate time.Time) ([]DeletedRecord, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM journal j
+		INNER JOIN (
+			SELECT z.id
+			FROM (
+				SELECT 
+					r.id,
+					r.seq,
+					r.balance,
+					MAX(CASE WHEN ABS(r.running) < 0.001 THEN r.seq END)
+						OVER (PARTITION BY r.referenceFk, r.itemFk, r.locationFk, r.shopFk) as last_zero_seq
+				FROM (
+					SELECT 
+						id,
+						referenceFk,
+						itemFk,
+						locationFk,
+						shopFk,
+						SUM(type * quantity) OVER (PARTITION BY referenceFk, itemFk, locationFk, shopFk
+							ORDER BY journalDate, id) as running,
+						ROW_NUMBER() OVER (PARTITION BY referenceFk, itemFk, locationFk, shopFk
+							ORDER BY journalDate, id) as seq,
+						SUM(type * quantity) OVER (PARTITION BY referenceFk, itemFk, locationFk, shopFk) as balance
+					FROM journal
+					WHERE accountFk = 2
+					  AND journalDate <= ?
+					  AND referenceFk IS NOT NULL
+					  AND %s
+				) r
+			) z
+			WHERE z.balance <> 0
+			  AND z.seq <= z.last_zero_seq
+		) zc ON j.id = zc.id
+		INNER JOIN form_detail fd ON j.detailFk = fd.id
+		INNER JOIN form_header fh ON fd.headerFk = fh.id
+		WHERE %s
+		  AND %s
+		ORDER BY j.referenceFk, j.itemFk, j.locationFk, j.shopFk, j.journalDate, j.id
+	`, deletedRecordColumns, cs.notDeleted(""), cs.notDeleted("fd"), cs.notDeleted("fh"))
+
+	rows, err := cs.conn().Query(query, cutoffDate.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDeletedRecords(rows)
+}